@@ -0,0 +1,234 @@
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"videoconverter/domain"
+	"videoconverter/domain/interactor"
+)
+
+// Server describe a REST API for controlling the converter in the server mode:
+//
+//	GET    /jobs                    states of all videos and renditions, ?state= filters by state
+//	GET    /jobs/{id}               states of the video and its renditions, encoding jobs have ffmpeg progress
+//	POST   /jobs/{id}               enqueue the video for making all missing formats
+//	DELETE /jobs/{id}               cancel processing of the video
+//	POST   /jobs/{id}/{rendition}   make the rendition again, "hls" and "dash" repackage the video
+//	GET    /metrics                 Prometheus metrics, it doesn't require the token
+type Server struct {
+	vc    *interactor.VideoCase
+	jobs  domain.JobStore
+	token string
+	srv   *http.Server
+
+	l domain.Logger
+}
+
+// NewServer returns a ready for use *Server listening on addr,
+// requests must have a bearer token if token isn't empty
+func NewServer(addr, token string, vc *interactor.VideoCase, jobs domain.JobStore, metrics http.Handler, l domain.Logger) *Server {
+	s := &Server{
+		vc:    vc,
+		jobs:  jobs,
+		token: token,
+		l:     l,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/jobs", s.auth(s.handleJobs))
+	mux.HandleFunc("/jobs/", s.auth(s.handleJob))
+	mux.Handle("/metrics", metrics)
+
+	s.srv = &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	return s
+}
+
+// ListenAndServe serves requests until Shutdown is called, then returns http.ErrServerClosed
+func (s *Server) ListenAndServe() error {
+	s.l.Info("API is listening", domain.F("addr", s.srv.Addr))
+
+	return s.srv.ListenAndServe()
+}
+
+// Shutdown stops accepting requests and waits for active ones until ctx is done
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.srv.Shutdown(ctx)
+}
+
+// auth checks the bearer token of a request
+func (s *Server) auth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.token != "" {
+			token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) != 1 {
+				s.error(w, http.StatusUnauthorized, errors.New("unauthorized"))
+				return
+			}
+		}
+
+		next(w, r)
+	}
+}
+
+// handleJobs handles GET /jobs
+func (s *Server) handleJobs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		s.error(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+
+	jobs, err := s.jobs.All()
+	if err != nil {
+		s.fail(w, err)
+		return
+	}
+
+	if state := r.URL.Query().Get("state"); state != "" {
+		filtered := []domain.Job{}
+
+		for _, j := range jobs {
+			if string(j.State) == state {
+				filtered = append(filtered, j)
+			}
+		}
+
+		jobs = filtered
+	}
+
+	if jobs == nil {
+		jobs = []domain.Job{}
+	}
+
+	s.json(w, http.StatusOK, s.withProgress(jobs))
+}
+
+// handleJob handles requests to /jobs/{id} and /jobs/{id}/{rendition}
+func (s *Server) handleJob(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/jobs/"), "/"), "/")
+	if len(parts) > 2 {
+		s.error(w, http.StatusNotFound, errors.New("not found"))
+		return
+	}
+
+	id, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		s.error(w, http.StatusBadRequest, errors.Errorf("invalid video id %s", parts[0]))
+		return
+	}
+
+	if len(parts) == 2 {
+		if r.Method != http.MethodPost {
+			s.error(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+			return
+		}
+
+		s.accepted(w, id, s.vc.Rerun(id, parts[1]))
+
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		jobs, err := s.jobs.Jobs(id)
+		if err != nil {
+			s.fail(w, err)
+			return
+		}
+
+		if len(jobs) == 0 {
+			s.error(w, http.StatusNotFound, errors.Errorf("no jobs of video %d", id))
+			return
+		}
+
+		s.json(w, http.StatusOK, s.withProgress(jobs))
+	case http.MethodPost:
+		s.accepted(w, id, s.vc.Enqueue(id))
+	case http.MethodDelete:
+		s.accepted(w, id, s.vc.Cancel(id))
+	default:
+		s.error(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	}
+}
+
+// accepted writes jobs of video with id if an action is succeeded or its error
+func (s *Server) accepted(w http.ResponseWriter, id int64, err error) {
+	if err != nil {
+		s.fail(w, err)
+		return
+	}
+
+	jobs, err := s.jobs.Jobs(id)
+	if err != nil {
+		s.fail(w, err)
+		return
+	}
+
+	s.json(w, http.StatusAccepted, s.withProgress(jobs))
+}
+
+// withProgress sets progress of running ffmpeg processes to encoding jobs
+func (s *Server) withProgress(jobs []domain.Job) []domain.Job {
+	progress := make(map[int64]map[string]domain.Progress)
+
+	for i, j := range jobs {
+		if j.State != domain.JobEncoding {
+			continue
+		}
+
+		if _, ok := progress[j.VideoID]; !ok {
+			progress[j.VideoID] = s.vc.Progress(j.VideoID)
+		}
+
+		if p, ok := progress[j.VideoID][j.Rendition]; ok {
+			jobs[i].Progress = &p
+		}
+	}
+
+	return jobs
+}
+
+// fail writes err with a status code depending on the error
+func (s *Server) fail(w http.ResponseWriter, err error) {
+	code := http.StatusInternalServerError
+
+	switch {
+	case errors.Is(err, domain.ErrNotFound), errors.Is(err, interactor.ErrNotActive):
+		code = http.StatusNotFound
+	case errors.Is(err, interactor.ErrUnknownRendition):
+		code = http.StatusBadRequest
+	case errors.Is(err, interactor.ErrBusy), errors.Is(err, interactor.ErrNothingToDo), errors.Is(err, interactor.ErrEmptyOriginal):
+		code = http.StatusConflict
+	case errors.Is(err, interactor.ErrQueueFull), errors.Is(err, interactor.ErrNotServing):
+		code = http.StatusServiceUnavailable
+	default:
+		s.l.Error("API request failed", domain.Err(err))
+	}
+
+	s.error(w, code, err)
+}
+
+// error writes err as {"error": "..."}
+func (s *Server) error(w http.ResponseWriter, code int, err error) {
+	s.json(w, code, map[string]string{"error": err.Error()})
+}
+
+// json writes v as a json response
+func (s *Server) json(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		s.l.Error("can't write API response", domain.Err(err))
+	}
+}
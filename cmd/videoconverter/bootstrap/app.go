@@ -1,37 +1,135 @@
 package bootstrap
 
 import (
+	"encoding/json"
 	"github.com/joho/godotenv"
+	"github.com/pkg/errors"
 	"os"
+	"runtime"
 	"strconv"
 	"strings"
 	"time"
+	"videoconverter/domain"
 )
 
 // App describe app configuration
 type App struct {
 	ENV             string
 	LogDir          string
+	LogLevel        Level
+	LogRotate       LogRotate
 	Temp            string
 	FfmpegVersion   string
 	Timeout         int
+	ShutdownGrace   time.Duration
 	ThreadMax       int
 	ThreadFfmpegMax int
 	Cloud           Cloud
 	DB              DB
+	Storage         string
+	Bitrix          Bitrix
 	SkipNotFull     bool
 	RmOriginal      bool
+	RmReplaced      bool
+	SinglePass      bool
+	Limits          domain.Limits
+	EncodeTimeouts  domain.EncodeTimeouts
+	Retry           domain.RetryPolicy
+	Renditions      []domain.Rendition
+	Packaging       domain.Packaging
+	API             API
+	// MetricsAddr is an address of a Prometheus /metrics endpoint, it isn't started if it's empty
+	MetricsAddr string
 }
 
+// LogRotate describe rotation of the log file, a rotated file is renamed with a timestamp suffix
+type LogRotate struct {
+	// MaxSize is a size in bytes after which the file is rotated, 0 disables rotation by size
+	MaxSize int64
+	// Interval rotates the file when a new period begins (e.g. every day for 24h), 0 disables rotation by time
+	Interval time.Duration
+	// MaxBackups is a count of kept rotated files, older files are deleted, 0 keeps all files
+	MaxBackups int
+	// Compress gzips rotated files
+	Compress bool
+}
+
+// API describe configuration of the REST API of the server mode
+type API struct {
+	Addr string
+	// Token is required in the Authorization header as a bearer token if it isn't empty
+	Token string
+}
+
+// Cloud backends
+const (
+	CloudPlatformcraft = "platformcraft"
+	CloudS3            = "s3"
+	CloudFS            = "fs"
+)
+
 // Cloud describe cloud configuration
 type Cloud struct {
+	Backend  string
 	Login    string
 	Password string
+	S3       S3
+	FS       FS
+}
+
+// S3 describe configuration of an S3-compatible storage
+type S3 struct {
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	// PublicURL is a base url of links to uploaded objects
+	PublicURL string
+}
+
+// FS describe configuration of a local filesystem storage
+type FS struct {
+	Dir string
+	// PublicURL is a base url of links to uploaded files
+	PublicURL string
+}
+
+// Metadata storages
+const (
+	StorageBitrix  = "bitrix"
+	StorageGeneric = "generic"
+)
+
+// Bitrix describe which iblocks of Bitrix contain videos
+type Bitrix struct {
+	IBlocks []IBlock
+	// OriginalProperty is a code of the property with a link to the original video
+	OriginalProperty string
+}
+
+// IBlock describe a Bitrix iblock by its type and code
+type IBlock struct {
+	Type string
+	Code string
+}
+
+func (b IBlock) String() string {
+	return b.Type + ":" + b.Code
 }
 
+// Database schemes
+const (
+	SchemeMySQL    = "mysql"
+	SchemePostgres = "postgres"
+	SchemeSQLite   = "sqlite3"
+)
+
 // DB describe database configuration
 type DB struct {
-	Scheme   string
+	Scheme string
+	// SSLMode is used by postgres only
+	SSLMode  string
 	Name     string
 	Host     string
 	Port     string
@@ -39,7 +137,7 @@ type DB struct {
 	Password string
 }
 
-// New parses .env file, create a logdir, tempdir and returns a ready for use App config
+// New parses .env file and returns a ready for use App config, the temp dir is created by MakeTemp
 func New(pathToConfig string) (*App, error) {
 	err := godotenv.Load(pathToConfig)
 	if err != nil {
@@ -53,7 +151,13 @@ func New(pathToConfig string) (*App, error) {
 	c.Temp = os.Getenv("TMP_DIR")
 	c.LogDir = os.Getenv("LOG_DIR")
 
-	if err = os.Mkdir(c.Temp, os.FileMode(0766)); err != nil && !os.IsExist(err) {
+	defaultLevel := "info"
+	if c.ENV == domain.EnvDebug {
+		defaultLevel = "debug"
+	}
+
+	c.LogLevel, err = ParseLevel(envString("LOG_LEVEL", defaultLevel))
+	if err != nil {
 		return nil, err
 	}
 
@@ -75,6 +179,18 @@ func New(pathToConfig string) (*App, error) {
 		return nil, err
 	}
 
+	if c.ShutdownGrace, err = envDuration("SHUTDOWN_GRACE", 5*time.Minute); err != nil {
+		return nil, err
+	}
+
+	if err = c.loadLogRotate(); err != nil {
+		return nil, err
+	}
+
+	if err = c.loadLimits(); err != nil {
+		return nil, err
+	}
+
 	isSkippNotFull, err := strconv.ParseBool(os.Getenv("SKIP_NOT_FULL"))
 	if err != nil {
 		return nil, err
@@ -87,19 +203,517 @@ func New(pathToConfig string) (*App, error) {
 	}
 	c.RmOriginal = isRmOriginal
 
+	if c.RmReplaced, err = envBool("RM_REPLACED", false); err != nil {
+		return nil, err
+	}
+
+	c.Cloud.Backend = envString("CLOUD_BACKEND", CloudPlatformcraft)
 	c.Cloud.Login = os.Getenv("CLOUD_LOGIN")
 	c.Cloud.Password = os.Getenv("CLOUD_PASSWORD")
 
+	c.Cloud.S3.Endpoint = os.Getenv("S3_ENDPOINT")
+	c.Cloud.S3.Region = envString("S3_REGION", "us-east-1")
+	c.Cloud.S3.Bucket = os.Getenv("S3_BUCKET")
+	c.Cloud.S3.AccessKey = os.Getenv("S3_ACCESS_KEY")
+	c.Cloud.S3.SecretKey = os.Getenv("S3_SECRET_KEY")
+	c.Cloud.S3.PublicURL = os.Getenv("S3_PUBLIC_URL")
+
+	c.Cloud.FS.Dir = os.Getenv("FS_DIR")
+	c.Cloud.FS.PublicURL = os.Getenv("FS_PUBLIC_URL")
+
+	switch c.Cloud.Backend {
+	case CloudPlatformcraft:
+	case CloudS3:
+		if c.Cloud.S3.Endpoint == "" || c.Cloud.S3.Bucket == "" {
+			return nil, errors.New("S3_ENDPOINT and S3_BUCKET are required for s3 cloud backend")
+		}
+	case CloudFS:
+		if c.Cloud.FS.Dir == "" || c.Cloud.FS.PublicURL == "" {
+			return nil, errors.New("FS_DIR and FS_PUBLIC_URL are required for fs cloud backend")
+		}
+	default:
+		return nil, errors.Errorf("unknown CLOUD_BACKEND %s", c.Cloud.Backend)
+	}
+
 	c.DB.Scheme = os.Getenv("DB_SCHEME")
 	c.DB.Host = os.Getenv("DB_HOST")
 	c.DB.Port = os.Getenv("DB_PORT")
 	c.DB.Name = os.Getenv("DB_NAME")
 	c.DB.Username = os.Getenv("DB_USERNAME")
 	c.DB.Password = os.Getenv("DB_PASSWORD")
+	c.DB.SSLMode = envString("DB_SSLMODE", "disable")
+
+	c.Storage = envString("STORAGE", StorageBitrix)
+	switch c.Storage {
+	case StorageBitrix:
+		if c.DB.Scheme != SchemeMySQL {
+			return nil, errors.Errorf("bitrix storage requires DB_SCHEME %s, got %s", SchemeMySQL, c.DB.Scheme)
+		}
+	case StorageGeneric:
+		if c.DB.Scheme != SchemePostgres && c.DB.Scheme != SchemeSQLite {
+			return nil, errors.Errorf("generic storage requires DB_SCHEME %s or %s, got %s", SchemePostgres, SchemeSQLite, c.DB.Scheme)
+		}
+	default:
+		return nil, errors.Errorf("unknown STORAGE %s", c.Storage)
+	}
+
+	c.Bitrix.OriginalProperty = envString("BITRIX_ORIGINAL_PROPERTY", "VIDEO_LINK")
+	c.Bitrix.IBlocks, err = parseIBlocks(envString("BITRIX_IBLOCKS", "content:lessons"))
+	if err != nil {
+		return nil, err
+	}
+
+	c.SinglePass, err = envBool("SINGLE_PASS", false)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = c.loadEncodeTimeouts(); err != nil {
+		return nil, err
+	}
+
+	if err = c.loadRetry(); err != nil {
+		return nil, err
+	}
+
+	profiles, err := loadEncodeProfiles(os.Getenv("ENCODE_PROFILES_FILE"))
+	if err != nil {
+		return nil, err
+	}
+
+	c.Renditions, err = loadRenditions(os.Getenv("RENDITIONS_FILE"), profiles)
+	if err != nil {
+		return nil, err
+	}
+
+	c.Packaging.HLS, err = envBool("HLS", false)
+	if err != nil {
+		return nil, err
+	}
+
+	c.Packaging.HLSProperty = envString("HLS_PROPERTY", "VIDEO_LINK_HLS")
+	c.Packaging.SegmentType = envString("HLS_SEGMENT_TYPE", "mpegts")
+	if c.Packaging.SegmentType != "mpegts" && c.Packaging.SegmentType != "fmp4" {
+		return nil, errors.Errorf("HLS_SEGMENT_TYPE must be mpegts or fmp4, got %s", c.Packaging.SegmentType)
+	}
+
+	c.Packaging.DASH, err = envBool("DASH", false)
+	if err != nil {
+		return nil, err
+	}
+
+	c.Packaging.DASHProperty = envString("DASH_PROPERTY", "VIDEO_LINK_DASH")
+
+	c.Packaging.SegmentTime, err = envInt("SEGMENT_TIME", 6)
+	if err != nil {
+		return nil, err
+	}
+
+	c.API.Addr = envString("API_ADDR", ":8080")
+	c.API.Token = os.Getenv("API_TOKEN")
+	c.MetricsAddr = os.Getenv("METRICS_ADDR")
 
 	return &c, nil
 }
 
-func timeFormat() string {
-	return time.Now().Format("2006-02-01 15:04:05")
+// MakeTemp creates the temp dir TMP_DIR if it isn't exists
+func (c *App) MakeTemp() error {
+	if err := os.Mkdir(c.Temp, os.FileMode(0766)); err != nil && !os.IsExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// loadLogRotate reads rotation settings of the log file
+func (c *App) loadLogRotate() error {
+	maxSize, err := envInt("LOG_MAX_SIZE", 100)
+	if err != nil {
+		return err
+	}
+
+	c.LogRotate.MaxSize = int64(maxSize) << 20
+
+	if c.LogRotate.Interval, err = envDuration("LOG_ROTATE_INTERVAL", 24*time.Hour); err != nil {
+		return err
+	}
+
+	if c.LogRotate.MaxBackups, err = envInt("LOG_MAX_BACKUPS", 7); err != nil {
+		return err
+	}
+
+	if c.LogRotate.Compress, err = envBool("LOG_COMPRESS", true); err != nil {
+		return err
+	}
+
+	if maxSize < 0 || c.LogRotate.Interval < 0 || c.LogRotate.MaxBackups < 0 {
+		return errors.New("LOG_MAX_SIZE, LOG_ROTATE_INTERVAL and LOG_MAX_BACKUPS must not be negative")
+	}
+
+	return nil
+}
+
+// loadLimits reads concurrency limits of processing stages,
+// ffmpeg processes can't use more than THREAD_MAX threads in total
+func (c *App) loadLimits() error {
+	threads := c.ThreadMax
+	if threads == 0 {
+		threads = runtime.NumCPU()
+	}
+
+	encodes := 1
+	if c.ThreadFfmpegMax > 0 && threads/c.ThreadFfmpegMax > 1 {
+		encodes = threads / c.ThreadFfmpegMax
+	}
+
+	var err error
+
+	if c.Limits.Encodes, err = envInt("ENCODE_MAX", encodes); err != nil {
+		return err
+	}
+
+	if c.ThreadFfmpegMax > 0 && c.Limits.Encodes*c.ThreadFfmpegMax > threads {
+		return errors.Errorf("ENCODE_MAX * THREAD_FFMPEG_MAX must be less or equal %d threads", threads)
+	}
+
+	if c.Limits.Downloads, err = envInt("DOWNLOAD_MAX", 1); err != nil {
+		return err
+	}
+
+	if c.Limits.Uploads, err = envInt("UPLOAD_MAX", 2); err != nil {
+		return err
+	}
+
+	if c.Limits.Videos, err = envInt("VIDEO_MAX", c.Limits.Encodes); err != nil {
+		return err
+	}
+
+	if c.Limits.Videos < 1 || c.Limits.Downloads < 1 || c.Limits.Encodes < 1 || c.Limits.Uploads < 1 {
+		return errors.New("VIDEO_MAX, DOWNLOAD_MAX, ENCODE_MAX and UPLOAD_MAX must be greater than 0")
+	}
+
+	return nil
+}
+
+// loadEncodeTimeouts reads limits of run time of ffmpeg processes
+func (c *App) loadEncodeTimeouts() error {
+	var err error
+
+	if c.EncodeTimeouts.Factor, err = envFloat("ENCODE_TIMEOUT_FACTOR", 10); err != nil {
+		return err
+	}
+
+	if c.EncodeTimeouts.Min, err = envDuration("ENCODE_TIMEOUT_MIN", 30*time.Minute); err != nil {
+		return err
+	}
+
+	if c.EncodeTimeouts.Stall, err = envDuration("ENCODE_STALL_TIMEOUT", 5*time.Minute); err != nil {
+		return err
+	}
+
+	if c.EncodeTimeouts.Factor < 0 || c.EncodeTimeouts.Min < 0 || c.EncodeTimeouts.Stall < 0 {
+		return errors.New("ENCODE_TIMEOUT_FACTOR, ENCODE_TIMEOUT_MIN and ENCODE_STALL_TIMEOUT must not be negative")
+	}
+
+	return nil
+}
+
+// loadRetry reads a retry policy of cloud operations
+func (c *App) loadRetry() error {
+	var err error
+
+	if c.Retry.MaxAttempts, err = envInt("RETRY_MAX_ATTEMPTS", 3); err != nil {
+		return err
+	}
+
+	if c.Retry.BaseDelay, err = envDuration("RETRY_BASE_DELAY", time.Second); err != nil {
+		return err
+	}
+
+	if c.Retry.MaxDelay, err = envDuration("RETRY_MAX_DELAY", time.Minute); err != nil {
+		return err
+	}
+
+	if c.Retry.Jitter, err = envFloat("RETRY_JITTER", 0.2); err != nil {
+		return err
+	}
+
+	if c.Retry.MaxAttempts < 1 || c.Retry.Jitter < 0 || c.Retry.Jitter > 1 {
+		return errors.New("RETRY_MAX_ATTEMPTS must be greater than 0, RETRY_JITTER must be from 0 to 1")
+	}
+
+	for _, code := range strings.Split(envString("RETRY_STATUS_CODES", "408,429,500,502,503,504"), ",") {
+		code = strings.TrimSpace(code)
+		if code == "" {
+			continue
+		}
+
+		i, err := strconv.Atoi(code)
+		if err != nil {
+			return errors.Wrap(err, "RETRY_STATUS_CODES")
+		}
+
+		c.Retry.StatusCodes = append(c.Retry.StatusCodes, i)
+	}
+
+	return nil
+}
+
+// parseIBlocks parses a comma separated list of iblocks in the format "type:code"
+func parseIBlocks(v string) ([]IBlock, error) {
+	var iblocks []IBlock
+
+	for _, item := range strings.Split(v, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		parts := strings.Split(item, ":")
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, errors.Errorf("BITRIX_IBLOCKS: %s must be in the format type:code", item)
+		}
+
+		iblocks = append(iblocks, IBlock{Type: parts[0], Code: parts[1]})
+	}
+
+	if len(iblocks) == 0 {
+		return nil, errors.New("BITRIX_IBLOCKS must contain at least one iblock")
+	}
+
+	return iblocks, nil
+}
+
+// envString returns a value of environment variable key or def if it isn't set
+func envString(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+
+	return def
+}
+
+// envBool parses environment variable key as bool, returns def if it isn't set
+func envBool(key string, def bool) (bool, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return def, nil
+	}
+
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, errors.Wrap(err, key)
+	}
+
+	return b, nil
+}
+
+// envInt parses environment variable key as int, returns def if it isn't set
+func envInt(key string, def int) (int, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return def, nil
+	}
+
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, errors.Wrap(err, key)
+	}
+
+	return i, nil
+}
+
+// envFloat parses environment variable key as float, returns def if it isn't set
+func envFloat(key string, def float64) (float64, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return def, nil
+	}
+
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0, errors.Wrap(err, key)
+	}
+
+	return f, nil
+}
+
+// envDuration parses environment variable key as duration (e.g. "1s", "5m"), returns def if it isn't set
+func envDuration(key string, def time.Duration) (time.Duration, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return def, nil
+	}
+
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, errors.Wrap(err, key)
+	}
+
+	return d, nil
+}
+
+// baselineEncoding is encoding settings of default renditions
+var baselineEncoding = domain.Encoding{Codec: "libx264", Container: domain.ContainerMP4, Profile: "baseline", CRF: 28, Preset: "faster", AudioCodec: "aac"}
+
+// aomSpeed is the default cpu-used of libaom-av1, from 0 (slowest) to 8 (fastest)
+const aomSpeed = "6"
+
+// defaultRenditions is a rendition ladder used if RENDITIONS_FILE isn't set
+var defaultRenditions = []domain.Rendition{
+	{Name: "1080", Height: 1080, Encoding: baselineEncoding, Property: "VIDEO_LINK_1080p"},
+	{Name: "720", Height: 720, Encoding: baselineEncoding, Property: "VIDEO_LINK_720p"},
+	{Name: "480", Height: 480, Encoding: baselineEncoding, Property: "VIDEO_LINK_480p"},
+	{Name: "360", Height: 360, Encoding: baselineEncoding, Property: "VIDEO_LINK_360p"},
+	{Name: "preview", Preview: true, Property: "VIDEO_LINK_PREVIEW"},
+}
+
+// loadEncodeProfiles reads encoding profiles by names from json file p, there are no profiles if p is empty
+func loadEncodeProfiles(p string) (map[string]domain.Encoding, error) {
+	profiles := make(map[string]domain.Encoding)
+
+	if p == "" {
+		return profiles, nil
+	}
+
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if err = json.NewDecoder(f).Decode(&profiles); err != nil {
+		return nil, errors.Wrapf(err, "parse %s", p)
+	}
+
+	for name, e := range profiles {
+		if e.MaxRate != "" && e.BufSize == "" {
+			return nil, errors.Errorf("encoding profile %s has maxrate without bufsize", name)
+		}
+	}
+
+	return profiles, nil
+}
+
+// loadRenditions reads a rendition ladder from json file p, renditions get settings of encoding profiles
+// by their names
+func loadRenditions(p string, profiles map[string]domain.Encoding) ([]domain.Rendition, error) {
+	if p == "" {
+		return defaultRenditions, nil
+	}
+
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var rr []domain.Rendition
+
+	if err = json.NewDecoder(f).Decode(&rr); err != nil {
+		return nil, errors.Wrapf(err, "parse %s", p)
+	}
+
+	if len(rr) == 0 {
+		return nil, errors.Errorf("%s has no renditions", p)
+	}
+
+	names := make(map[string]bool, len(rr))
+	codes := make(map[string]bool, len(rr))
+
+	for i := range rr {
+		r := &rr[i]
+
+		switch {
+		case r.Name == "":
+			return nil, errors.Errorf("rendition #%d has no name", i)
+		case r.Property == "":
+			return nil, errors.Errorf("rendition %s has no property code", r.Name)
+		case !r.Preview && r.Height <= 0:
+			return nil, errors.Errorf("rendition %s has no height", r.Name)
+		case r.Preview && r.Variant != "":
+			return nil, errors.Errorf("preview %s can't be a variant", r.Name)
+		case names[r.Name]:
+			return nil, errors.Errorf("rendition %s is duplicated", r.Name)
+		case codes[r.Property]:
+			return nil, errors.Errorf("property %s is used by several renditions", r.Property)
+		}
+
+		names[r.Name] = true
+		codes[r.Property] = true
+
+		if r.EncodeProfile != "" {
+			e, ok := profiles[r.EncodeProfile]
+
+			switch {
+			case !ok:
+				return nil, errors.Errorf("rendition %s has unknown encoding profile %s", r.Name, r.EncodeProfile)
+			case r.Encoding != domain.Encoding{}:
+				return nil, errors.Errorf("rendition %s has both encoding profile and inline encoding settings", r.Name)
+			}
+
+			r.Encoding = e
+		}
+
+		r.Encoding = withDefaults(r.Encoding)
+
+		switch {
+		case r.MaxRate != "" && r.BufSize == "":
+			return nil, errors.Errorf("rendition %s has maxrate without bufsize", r.Name)
+		case r.Container != domain.ContainerMP4 && r.Container != domain.ContainerWebM:
+			return nil, errors.Errorf("rendition %s has unknown container %s", r.Name, r.Container)
+		case r.Container == domain.ContainerWebM && !webmCodecs[r.Codec]:
+			return nil, errors.Errorf("rendition %s has codec %s which can't be stored in webm", r.Name, r.Codec)
+		}
+	}
+
+	return rr, nil
+}
+
+// webmCodecs are ffmpeg encoders of VP8, VP9 and AV1 which can be stored in webm
+var webmCodecs = map[string]bool{
+	"libvpx":     true,
+	"libvpx-vp9": true,
+	"libaom-av1": true,
+	"libsvtav1":  true,
+	"librav1e":   true,
+}
+
+// withDefaults fills settings of e which aren't set by settings of the default renditions,
+// VP8 and VP9 are stored in webm with Opus audio
+func withDefaults(e domain.Encoding) domain.Encoding {
+	if e.Codec == "" {
+		e.Codec = baselineEncoding.Codec
+	}
+
+	if e.Container == "" {
+		e.Container = domain.ContainerMP4
+		if strings.HasPrefix(e.Codec, "libvpx") {
+			e.Container = domain.ContainerWebM
+		}
+	}
+
+	// CRF 0 is lossless and isn't allowed with the baseline profile
+	if e.CRF == 0 && e.Bitrate == "" {
+		e.CRF = baselineEncoding.CRF
+	}
+
+	// presets of other codecs have different names or are numbers
+	if e.Preset == "" && (e.Codec == "libx264" || e.Codec == "libx265") {
+		e.Preset = baselineEncoding.Preset
+	}
+
+	// cpu-used of libaom-av1 is 1 by default, which is too slow to encode a video within the timeout
+	if e.Preset == "" && e.Codec == "libaom-av1" {
+		e.Preset = aomSpeed
+	}
+
+	if e.AudioCodec == "" {
+		e.AudioCodec = baselineEncoding.AudioCodec
+		if e.Container == domain.ContainerWebM {
+			e.AudioCodec = "libopus"
+		}
+	}
+
+	return e
 }
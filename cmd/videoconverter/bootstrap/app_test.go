@@ -0,0 +1,47 @@
+package bootstrap
+
+import (
+	"testing"
+	"videoconverter/domain"
+)
+
+func TestWithDefaults(t *testing.T) {
+	tests := []struct {
+		name string
+		enc  domain.Encoding
+		want domain.Encoding
+	}{
+		{
+			name: "empty",
+			want: domain.Encoding{Codec: "libx264", Container: domain.ContainerMP4, CRF: 28, Preset: "faster", AudioCodec: "aac"},
+		},
+		{
+			name: "bitrate without crf",
+			enc:  domain.Encoding{Bitrate: "2500k"},
+			want: domain.Encoding{Codec: "libx264", Container: domain.ContainerMP4, Bitrate: "2500k", Preset: "faster", AudioCodec: "aac"},
+		},
+		{
+			name: "settings are kept",
+			enc:  domain.Encoding{Codec: "libx265", CRF: 23, Preset: "slow", AudioCodec: "libopus"},
+			want: domain.Encoding{Codec: "libx265", Container: domain.ContainerMP4, CRF: 23, Preset: "slow", AudioCodec: "libopus"},
+		},
+		{
+			name: "vp9 in webm",
+			enc:  domain.Encoding{Codec: "libvpx-vp9", CRF: 33},
+			want: domain.Encoding{Codec: "libvpx-vp9", Container: domain.ContainerWebM, CRF: 33, AudioCodec: "libopus"},
+		},
+		{
+			name: "av1 gets the default speed",
+			enc:  domain.Encoding{Codec: "libaom-av1"},
+			want: domain.Encoding{Codec: "libaom-av1", Container: domain.ContainerMP4, CRF: 28, Preset: "6", AudioCodec: "aac"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := withDefaults(tt.enc); got != tt.want {
+				t.Errorf("withDefaults() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -3,11 +3,12 @@ package bootstrap
 import (
 	"fmt"
 	"github.com/gocraft/dbr"
+	"net"
+	"net/url"
 )
 
 func Open(c DB) (*dbr.Connection, error) {
-	dsn := fmt.Sprintf("%s:%s@tcp(%s:%s)/%s", c.Username, c.Password, c.Host, c.Port, c.Name)
-	conn, err := dbr.Open(c.Scheme, dsn, nil)
+	conn, err := dbr.Open(c.Scheme, dsn(c), nil)
 	if err != nil {
 		return nil, err
 	}
@@ -17,6 +18,32 @@ func Open(c DB) (*dbr.Connection, error) {
 	}
 
 	conn.SetMaxOpenConns(10)
+	if c.Scheme == SchemeSQLite {
+		// sqlite allows only one writer at the same time
+		conn.SetMaxOpenConns(1)
+	}
 
 	return conn, nil
 }
+
+// dsn returns a data source name in the format of the driver of the database scheme,
+// for sqlite DB_NAME is a path to the database file
+func dsn(c DB) string {
+	switch c.Scheme {
+	case SchemePostgres:
+		u := url.URL{
+			Scheme:   "postgres",
+			User:     url.UserPassword(c.Username, c.Password),
+			Host:     net.JoinHostPort(c.Host, c.Port),
+			Path:     "/" + c.Name,
+			RawQuery: url.Values{"sslmode": {c.SSLMode}}.Encode(),
+		}
+
+		return u.String()
+	case SchemeSQLite:
+		return "file:" + c.Name + "?_foreign_keys=on&_busy_timeout=5000"
+	}
+
+	// bitrix writes DATETIME columns in the local time, so times are sent and parsed in the same zone
+	return fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?parseTime=true&loc=Local", c.Username, c.Password, c.Host, c.Port, c.Name)
+}
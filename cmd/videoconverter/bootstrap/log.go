@@ -1,62 +1,200 @@
 package bootstrap
 
 import (
-	"log"
+	"bytes"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"io"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 	"videoconverter/domain"
 )
 
+// Level is a severity of a log entry
+type Level int
+
+// Levels of log entries
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = map[Level]string{
+	LevelDebug: "debug",
+	LevelInfo:  "info",
+	LevelWarn:  "warn",
+	LevelError: "error",
+}
+
+func (l Level) String() string {
+	return levelNames[l]
+}
+
+// ParseLevel returns a level by its name
+func ParseLevel(s string) (Level, error) {
+	for l, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return l, nil
+		}
+	}
+
+	return LevelDebug, errors.Errorf("unknown log level %s", s)
+}
+
+// logOutput is shared by a logger and all loggers made by its With method
+type logOutput struct {
+	mu      sync.Mutex
+	f       *rotateFile
+	console io.Writer
+	// consoleLevel is a minimal level of entries printed to the console
+	consoleLevel Level
+}
+
+// Logger writes log entries as JSON lines into the log file and the console
 type Logger struct {
-	env string
-	f   *os.File
-	log *log.Logger
+	level  Level
+	out    *logOutput
+	fields []domain.Field
 }
 
-// NewLog creates a new logfile into with current date into logDir
-func NewLog(env, logDir string) (*Logger, error) {
+// NewLog creates a logfile video-converter.log into logDir which is rotated by conf,
+// entries with level lower than level are skipped.
+// In debug env all entries are printed to the console too, in other envs only errors.
+func NewLog(env, logDir string, level Level, conf LogRotate) (*Logger, error) {
 	if err := os.Mkdir(logDir, os.FileMode(0766)); err != nil && !os.IsExist(err) {
 		return nil, err
 	}
 
-	f, err := os.OpenFile(logDir+"/video-converter.log", os.O_CREATE|os.O_APPEND|os.O_RDWR, os.FileMode(0660))
+	f, err := openRotateFile(filepath.Join(logDir, "video-converter.log"), conf)
 	if err != nil {
 		return nil, err
 	}
 
-	l := log.New(os.Stdout, "", 0)
+	consoleLevel := LevelError
+	if env == domain.EnvDebug {
+		consoleLevel = level
+	}
 
 	return &Logger{
-		env: env,
-		f:   f,
-		log: l,
-	}, err
+		level: level,
+		out: &logOutput{
+			f:            f,
+			console:      os.Stdout,
+			consoleLevel: consoleLevel,
+		},
+	}, nil
+}
+
+// NewConsoleLog returns a logger which prints entries to w only, without a logfile,
+// e.g. when stdout is used for a program output. Levels of entries are filtered as by NewLog.
+func NewConsoleLog(env string, level Level, w io.Writer) *Logger {
+	consoleLevel := LevelError
+	if env == domain.EnvDebug {
+		consoleLevel = level
+	}
+
+	return &Logger{
+		level: level,
+		out: &logOutput{
+			console:      w,
+			consoleLevel: consoleLevel,
+		},
+	}
 }
 
 func (l *Logger) Close() error {
-	return l.f.Close()
+	if l.out.f == nil {
+		return nil
+	}
+
+	return l.out.f.Close()
 }
 
-func (l *Logger) E(s ...string) {
-	b := &strings.Builder{}
-	b.WriteString(timeFormat())
-	b.WriteString(" [ERROR] ")
-	b.WriteString(strings.Join(s, " "))
+// Debug writes an entry with debug level
+func (l *Logger) Debug(msg string, fields ...domain.Field) {
+	l.write(LevelDebug, msg, fields)
+}
 
-	l.f.WriteString(b.String() + "\n")
+// Info writes an entry with info level
+func (l *Logger) Info(msg string, fields ...domain.Field) {
+	l.write(LevelInfo, msg, fields)
+}
+
+// Warn writes an entry with warn level
+func (l *Logger) Warn(msg string, fields ...domain.Field) {
+	l.write(LevelWarn, msg, fields)
+}
+
+// Error writes an entry with error level
+func (l *Logger) Error(msg string, fields ...domain.Field) {
+	l.write(LevelError, msg, fields)
+}
+
+// With returns a logger which adds fields to every entry
+func (l *Logger) With(fields ...domain.Field) domain.Logger {
+	all := make([]domain.Field, 0, len(l.fields)+len(fields))
+	all = append(all, l.fields...)
+	all = append(all, fields...)
+
+	return &Logger{
+		level:  l.level,
+		out:    l.out,
+		fields: all,
+	}
+}
+
+// write writes an entry as one JSON line: time, level and msg go first, then fields in order they were added
+func (l *Logger) write(level Level, msg string, fields []domain.Field) {
+	if level < l.level {
+		return
+	}
+
+	b := &bytes.Buffer{}
+	b.WriteString(`{"time":`)
+	writeJSON(b, time.Now().Format(time.RFC3339Nano))
+	b.WriteString(`,"level":`)
+	writeJSON(b, level.String())
+	b.WriteString(`,"msg":`)
+	writeJSON(b, msg)
+
+	for _, fields := range [][]domain.Field{l.fields, fields} {
+		for _, f := range fields {
+			b.WriteByte(',')
+			writeJSON(b, f.Key)
+			b.WriteByte(':')
+			writeJSON(b, f.Value)
+		}
+	}
+
+	b.WriteString("}\n")
+
+	l.out.mu.Lock()
+	defer l.out.mu.Unlock()
 
-	if l.env == domain.EnvDebug {
-		l.log.Println(b.String())
+	if l.out.f != nil {
+		l.out.f.Write(b.Bytes())
+	}
+
+	if level >= l.out.consoleLevel {
+		l.out.console.Write(b.Bytes())
 	}
 }
 
-func (l *Logger) D(s ...string) {
-	if l.env == domain.EnvDebug {
-		b := &strings.Builder{}
-		b.WriteString(timeFormat())
-		b.WriteString(" [DEBUG] ")
-		b.WriteString(strings.Join(s, " "))
+// writeJSON writes v encoded as JSON, values which can't be encoded are written as strings
+func writeJSON(b *bytes.Buffer, v interface{}) {
+	if err, ok := v.(error); ok {
+		v = err.Error()
+	}
 
-		l.log.Println(b.String())
+	data, err := json.Marshal(v)
+	if err != nil {
+		data, _ = json.Marshal(err.Error())
 	}
+
+	b.Write(data)
 }
@@ -0,0 +1,249 @@
+package bootstrap
+
+import (
+	"compress/gzip"
+	"github.com/pkg/errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// backupTimeFormat is a timestamp of rotated files, it's sorted in the order of rotation
+const backupTimeFormat = "2006-01-02T15-04-05.000"
+
+// rotateFile is a log file which is renamed and replaced by a new one when it's too large or a new period begins,
+// rotated files are compressed and the oldest ones are deleted in the background
+type rotateFile struct {
+	path string
+	conf LogRotate
+
+	f      *os.File
+	size   int64
+	period time.Time
+
+	// mill serializes compressing and deleting of rotated files
+	mill sync.Mutex
+	wg   sync.WaitGroup
+}
+
+// openRotateFile opens the log file path for appending, the file is rotated at once
+// if it was last written in a previous period
+func openRotateFile(path string, conf LogRotate) (*rotateFile, error) {
+	r := &rotateFile{path: path, conf: conf}
+
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+
+	if r.size > 0 && r.newPeriod(time.Now()) {
+		if err := r.rotate(); err != nil {
+			return nil, err
+		}
+	}
+
+	r.wg.Add(1)
+	go r.cleanup("")
+
+	return r, nil
+}
+
+// Write writes p into the file, the file is rotated before if p exceeds its max size or a new period has begun.
+// It isn't safe for concurrent use, the logger calls it under its lock.
+func (r *rotateFile) Write(p []byte) (int, error) {
+	if r.size > 0 && (r.conf.MaxSize > 0 && r.size+int64(len(p)) > r.conf.MaxSize || r.newPeriod(time.Now())) {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+
+	return n, err
+}
+
+// Close closes the file and waits for compressing of rotated files
+func (r *rotateFile) Close() error {
+	err := r.f.Close()
+	r.wg.Wait()
+
+	return err
+}
+
+// open opens the file and reads its size and the period of its last write
+func (r *rotateFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_APPEND|os.O_RDWR, os.FileMode(0660))
+	if err != nil {
+		return err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return errors.WithStack(err)
+	}
+
+	r.f = f
+	r.size = info.Size()
+	r.period = info.ModTime()
+
+	if r.size == 0 {
+		r.period = time.Now()
+	}
+
+	r.period = r.truncate(r.period)
+
+	return nil
+}
+
+// newPeriod reports whether t is in a later rotation period than the file
+func (r *rotateFile) newPeriod(t time.Time) bool {
+	return r.conf.Interval > 0 && r.truncate(t).After(r.period)
+}
+
+// truncate returns the beginning of the rotation period of t
+func (r *rotateFile) truncate(t time.Time) time.Time {
+	if r.conf.Interval <= 0 {
+		return time.Time{}
+	}
+
+	return t.Truncate(r.conf.Interval)
+}
+
+// rotate renames the file with a timestamp suffix and opens a new one
+func (r *rotateFile) rotate() error {
+	if err := r.f.Close(); err != nil {
+		return errors.WithStack(err)
+	}
+
+	ext := filepath.Ext(r.path)
+	backup := strings.TrimSuffix(r.path, ext) + "-" + time.Now().Format(backupTimeFormat) + ext
+
+	// the file is reopened anyway to keep logging if it can't be renamed
+	if err := os.Rename(r.path, backup); err != nil {
+		if err := r.open(); err != nil {
+			return err
+		}
+
+		return errors.WithStack(err)
+	}
+
+	if err := r.open(); err != nil {
+		return err
+	}
+
+	r.wg.Add(1)
+	go r.cleanup(backup)
+
+	return nil
+}
+
+// cleanup compresses the rotated file backup and deletes rotated files over the retention count,
+// errors are printed to stderr because the logger can't write them into its own file
+func (r *rotateFile) cleanup(backup string) {
+	defer r.wg.Done()
+
+	r.mill.Lock()
+	defer r.mill.Unlock()
+
+	if backup != "" && r.conf.Compress {
+		if err := compress(backup); err != nil {
+			log.Println("Log rotation:", err)
+		}
+	}
+
+	if r.conf.MaxBackups == 0 {
+		return
+	}
+
+	backups, err := r.backups()
+	if err != nil {
+		log.Println("Log rotation:", err)
+		return
+	}
+
+	for len(backups) > r.conf.MaxBackups {
+		if err := os.Remove(backups[0]); err != nil {
+			log.Println("Log rotation:", err)
+		}
+
+		backups = backups[1:]
+	}
+}
+
+// backups returns rotated files from the oldest to the newest
+func (r *rotateFile) backups() ([]string, error) {
+	ext := filepath.Ext(r.path)
+	prefix := strings.TrimSuffix(filepath.Base(r.path), ext) + "-"
+
+	entries, err := os.ReadDir(filepath.Dir(r.path))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	var backups []string
+
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+
+		stamp := strings.TrimSuffix(strings.TrimSuffix(strings.TrimPrefix(name, prefix), ".gz"), ext)
+		if _, err := time.Parse(backupTimeFormat, stamp); err != nil {
+			continue
+		}
+
+		backups = append(backups, filepath.Join(filepath.Dir(r.path), name))
+	}
+
+	sort.Slice(backups, func(i, j int) bool {
+		return filepath.Base(backups[i]) < filepath.Base(backups[j])
+	})
+
+	return backups, nil
+}
+
+// compress gzips file path into path.gz and removes path
+func compress(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, os.FileMode(0660))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	zw := gzip.NewWriter(dst)
+
+	if _, err := io.Copy(zw, src); err != nil {
+		dst.Close()
+		os.Remove(dst.Name())
+
+		return errors.WithStack(err)
+	}
+
+	if err := zw.Close(); err != nil {
+		dst.Close()
+		os.Remove(dst.Name())
+
+		return errors.WithStack(err)
+	}
+
+	if err := dst.Close(); err != nil {
+		os.Remove(dst.Name())
+		return errors.WithStack(err)
+	}
+
+	src.Close()
+
+	return errors.WithStack(os.Remove(path))
+}
@@ -0,0 +1,64 @@
+package bootstrap
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRotateFilePeriod(t *testing.T) {
+	day := time.Date(2026, 10, 18, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name       string
+		interval   time.Duration
+		written    time.Time
+		now        time.Time
+		wantPeriod time.Time
+		wantNew    bool
+	}{
+		{
+			name:       "same day",
+			interval:   24 * time.Hour,
+			written:    day.Add(time.Hour),
+			now:        day.Add(23 * time.Hour),
+			wantPeriod: day,
+		},
+		{
+			name:       "next day",
+			interval:   24 * time.Hour,
+			written:    day.Add(23 * time.Hour),
+			now:        day.Add(25 * time.Hour),
+			wantPeriod: day,
+			wantNew:    true,
+		},
+		{
+			name:       "next hour",
+			interval:   time.Hour,
+			written:    day.Add(90 * time.Minute),
+			now:        day.Add(2 * time.Hour),
+			wantPeriod: day.Add(time.Hour),
+			wantNew:    true,
+		},
+		{
+			name:    "rotation by time is disabled",
+			written: day,
+			now:     day.Add(48 * time.Hour),
+			wantNew: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &rotateFile{conf: LogRotate{Interval: tt.interval}}
+			r.period = r.truncate(tt.written)
+
+			if !r.period.Equal(tt.wantPeriod) {
+				t.Errorf("truncate() = %v, want %v", r.period, tt.wantPeriod)
+			}
+
+			if got := r.newPeriod(tt.now); got != tt.wantNew {
+				t.Errorf("newPeriod() = %v, want %v", got, tt.wantNew)
+			}
+		})
+	}
+}
@@ -0,0 +1,10 @@
+package domain
+
+import "github.com/pkg/errors"
+
+var (
+	// ErrNotFound is returned by storages when a video isn't exists
+	ErrNotFound = errors.New("video is not found")
+	// ErrLinkChanged is returned by storages when a replaced link was changed by someone else
+	ErrLinkChanged = errors.New("link is changed since the video was read")
+)
@@ -1,6 +1,7 @@
 package domain
 
 import (
+	"path"
 	"regexp"
 	"strings"
 )
@@ -12,3 +13,41 @@ func FormatFileName(n string) string {
 	clear := r.ReplaceAllString(trim, "_")
 	return clear + ".mp4"
 }
+
+// PropertyCodes returns database property codes of renditions rr
+func PropertyCodes(rr []Rendition) []string {
+	codes := make([]string, 0, len(rr))
+	for _, r := range rr {
+		codes = append(codes, r.Property)
+	}
+
+	return codes
+}
+
+// RenditionNames returns names of renditions rr
+func RenditionNames(rr []Rendition) []string {
+	names := make([]string, 0, len(rr))
+	for _, r := range rr {
+		names = append(names, r.Name)
+	}
+
+	return names
+}
+
+// DownloadMetaPath returns a path of a file which keeps the ETag of the partially downloaded file p,
+// it's used to resume downloads
+func DownloadMetaPath(p string) string {
+	return p + ".etag"
+}
+
+// Versioned adds version to the file or dir name before its extension,
+// name is returned as is if version is empty
+func Versioned(name, version string) string {
+	if version == "" {
+		return name
+	}
+
+	ext := path.Ext(name)
+
+	return strings.TrimSuffix(name, ext) + "-v" + version + ext
+}
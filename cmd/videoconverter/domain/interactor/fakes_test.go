@@ -0,0 +1,422 @@
+package interactor
+
+import (
+	"context"
+	"fmt"
+	"github.com/gocraft/dbr"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"videoconverter/domain"
+)
+
+// cloudURL is a prefix of links to files of fakeCloud
+const cloudURL = "http://cloud/"
+
+// fakeStorage keeps videos in memory, videos are copied, so changes of a returned video aren't saved
+type fakeStorage struct {
+	mu     sync.Mutex
+	videos map[int64]*domain.Video
+}
+
+func newFakeStorage(videos ...*domain.Video) *fakeStorage {
+	s := &fakeStorage{videos: make(map[int64]*domain.Video)}
+	for _, v := range videos {
+		s.videos[v.ID] = copyVideo(v)
+	}
+
+	return s
+}
+
+func (s *fakeStorage) Videos() ([]domain.Video, error) {
+	return s.FilterVideos(domain.VideoFilter{})
+}
+
+func (s *fakeStorage) FilterVideos(f domain.VideoFilter) ([]domain.Video, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var videos []domain.Video
+	for _, v := range s.videos {
+		if len(f.IDs) > 0 && !f.IsRequested(v.ID) {
+			continue
+		}
+
+		videos = append(videos, *copyVideo(v))
+	}
+
+	sort.Slice(videos, func(i, j int) bool { return videos[i].ID < videos[j].ID })
+
+	return videos, nil
+}
+
+func (s *fakeStorage) Video(id int64) (*domain.Video, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	v, ok := s.videos[id]
+	if !ok {
+		return nil, domain.ErrNotFound
+	}
+
+	return copyVideo(v), nil
+}
+
+func (s *fakeStorage) SetLink(v *domain.Video, code, link string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.videos[v.ID].SetLink(code, link)
+	v.SetLink(code, link)
+
+	return nil
+}
+
+func (s *fakeStorage) ReplaceLink(v *domain.Video, code, old, link string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.videos[v.ID].Link(code) != old {
+		return domain.ErrLinkChanged
+	}
+
+	s.videos[v.ID].SetLink(code, link)
+	v.SetLink(code, link)
+
+	return nil
+}
+
+func (s *fakeStorage) ClearOriginal(v *domain.Video) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.videos[v.ID].LinkOrig = dbr.NullString{}
+	v.LinkOrig = dbr.NullString{}
+
+	return nil
+}
+
+// link returns a saved link of video with id
+func (s *fakeStorage) link(id int64, code string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.videos[id].Link(code)
+}
+
+// copyVideo returns a copy of v with its own properties
+func copyVideo(v *domain.Video) *domain.Video {
+	c := *v
+	c.Props = make(map[string]*domain.Property, len(v.Props))
+
+	for code, p := range v.Props {
+		cp := *p
+		c.Props[code] = &cp
+	}
+
+	return &c
+}
+
+// newVideo returns a video with a link to the original in fakeCloud and links by property codes
+func newVideo(id int64, links map[string]string) *domain.Video {
+	v := &domain.Video{
+		ID:       id,
+		LinkOrig: dbr.NewNullString(fmt.Sprintf("%svideos/%d.mp4", cloudURL, id)),
+		Props:    make(map[string]*domain.Property),
+	}
+
+	for code, link := range links {
+		v.SetLink(code, link)
+	}
+
+	return v
+}
+
+// fakeJobs keeps states of jobs in memory
+type fakeJobs struct {
+	mu   sync.Mutex
+	jobs map[int64]map[string]domain.Job
+}
+
+func newFakeJobs(jobs ...domain.Job) *fakeJobs {
+	s := &fakeJobs{jobs: make(map[int64]map[string]domain.Job)}
+	for _, j := range jobs {
+		s.SetState(j.VideoID, j.Rendition, j.State, j.Error)
+	}
+
+	return s
+}
+
+func (s *fakeJobs) SetState(videoID int64, rendition string, state domain.JobState, msg string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.jobs[videoID] == nil {
+		s.jobs[videoID] = make(map[string]domain.Job)
+	}
+
+	s.jobs[videoID][rendition] = domain.Job{VideoID: videoID, Rendition: rendition, State: state, Error: msg, UpdatedAt: time.Now()}
+
+	return nil
+}
+
+func (s *fakeJobs) Jobs(videoID int64) ([]domain.Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var jobs []domain.Job
+	for _, j := range s.jobs[videoID] {
+		jobs = append(jobs, j)
+	}
+
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].Rendition < jobs[j].Rendition })
+
+	return jobs, nil
+}
+
+func (s *fakeJobs) All() ([]domain.Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var jobs []domain.Job
+	for _, jj := range s.jobs {
+		for _, j := range jj {
+			jobs = append(jobs, j)
+		}
+	}
+
+	return jobs, nil
+}
+
+func (s *fakeJobs) Unfinished() ([]domain.Job, error) {
+	all, _ := s.All()
+
+	var jobs []domain.Job
+	for _, j := range all {
+		if !j.State.IsFinal() {
+			jobs = append(jobs, j)
+		}
+	}
+
+	return jobs, nil
+}
+
+// state returns a state of the job or an empty state if there is no job
+func (s *fakeJobs) state(videoID int64, rendition string) domain.JobState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.jobs[videoID][rendition].State
+}
+
+// fakeEncoder writes names of made formats into files instead of encoding,
+// err fails all runs and media is returned by Probe
+type fakeEncoder struct {
+	mu    sync.Mutex
+	media *domain.MediaInfo
+	err   error
+	// converted are renditions passed to Convert and ConvertAll
+	converted []domain.Rendition
+	// packaged are files passed to Package
+	packaged map[string]string
+}
+
+func (e *fakeEncoder) Probe(ctx context.Context, filePath string) (*domain.MediaInfo, error) {
+	if e.media == nil {
+		return nil, fmt.Errorf("can't probe %s", filePath)
+	}
+
+	return e.media, nil
+}
+
+func (e *fakeEncoder) Convert(ctx context.Context, tmp string, filePath string, r domain.Rendition) (string, error) {
+	e.mu.Lock()
+	e.converted = append(e.converted, r)
+	e.mu.Unlock()
+
+	return e.write(tmp, filePath, r.Name)
+}
+
+func (e *fakeEncoder) CreatePreview(ctx context.Context, tmp, filePath string) (string, error) {
+	return e.write(tmp, filePath, "preview")
+}
+
+func (e *fakeEncoder) ConvertAll(ctx context.Context, tmp, filePath string, rr []domain.Rendition) (map[string]string, error) {
+	files := make(map[string]string, len(rr))
+
+	for _, r := range rr {
+		if !r.Preview {
+			e.mu.Lock()
+			e.converted = append(e.converted, r)
+			e.mu.Unlock()
+		}
+
+		f, err := e.write(tmp, filePath, r.Name)
+		if err != nil {
+			return nil, err
+		}
+
+		files[r.Name] = f
+	}
+
+	return files, nil
+}
+
+func (e *fakeEncoder) Package(ctx context.Context, tmp, filePath string, rr []domain.Rendition, files map[string]string, p domain.Packaging, audio bool) (*domain.Package, error) {
+	if e.err != nil {
+		return nil, e.err
+	}
+
+	e.mu.Lock()
+	e.packaged = make(map[string]string, len(files))
+	for name, f := range files {
+		e.packaged[name] = f
+	}
+	e.mu.Unlock()
+
+	dir := filepath.Join(tmp, "stream-"+strings.TrimSuffix(filepath.Base(filePath), ".mp4"))
+	if err := os.MkdirAll(dir, 0766); err != nil {
+		return nil, err
+	}
+
+	pkg := &domain.Package{Dir: dir}
+	if p.HLS {
+		pkg.HLSMaster = "master.m3u8"
+		if err := os.WriteFile(filepath.Join(dir, pkg.HLSMaster), []byte("hls"), 0664); err != nil {
+			return nil, err
+		}
+	}
+
+	if p.DASH {
+		pkg.DASHManifest = "manifest.mpd"
+		if err := os.WriteFile(filepath.Join(dir, pkg.DASHManifest), []byte("dash"), 0664); err != nil {
+			return nil, err
+		}
+	}
+
+	return pkg, nil
+}
+
+// write creates a file of format name of the original filePath in tmp
+func (e *fakeEncoder) write(tmp, filePath, name string) (string, error) {
+	if e.err != nil {
+		return "", e.err
+	}
+
+	f := filepath.Join(tmp, fmt.Sprintf("v-%s-%s", name, filepath.Base(filePath)))
+
+	return f, os.WriteFile(f, []byte(name), 0664)
+}
+
+// fakeCloud keeps uploaded files in memory, links are cloudURL with a path
+type fakeCloud struct {
+	mu    sync.Mutex
+	files map[string][]byte
+}
+
+func newFakeCloud() *fakeCloud {
+	return &fakeCloud{files: make(map[string][]byte)}
+}
+
+func (c *fakeCloud) DownloadFile(ctx context.Context, u string, f *os.File) error {
+	_, err := f.WriteString(u)
+	return err
+}
+
+func (c *fakeCloud) UploadFile(ctx context.Context, path string, f *os.File) (string, error) {
+	b, err := os.ReadFile(f.Name())
+	if err != nil {
+		return "", err
+	}
+
+	c.mu.Lock()
+	c.files[path] = b
+	c.mu.Unlock()
+
+	return cloudURL + path, nil
+}
+
+func (c *fakeCloud) Delete(ctx context.Context, filepath string) error {
+	c.mu.Lock()
+	delete(c.files, filepath)
+	c.mu.Unlock()
+
+	return nil
+}
+
+func (c *fakeCloud) Path(u string) (string, error) {
+	if !strings.HasPrefix(u, cloudURL) {
+		return "", fmt.Errorf("%s isn't a link to the cloud", u)
+	}
+
+	return strings.TrimPrefix(u, cloudURL), nil
+}
+
+// fakeMetrics counts queued videos only
+type fakeMetrics struct {
+	mu     sync.Mutex
+	queued int
+}
+
+func (m *fakeMetrics) VideosFound(n int) {}
+
+func (m *fakeMetrics) Queued(delta int) {
+	m.mu.Lock()
+	m.queued += delta
+	m.mu.Unlock()
+}
+
+func (m *fakeMetrics) Processing(delta int)                                 {}
+func (m *fakeMetrics) Downloaded(bytes int64, err error)                    {}
+func (m *fakeMetrics) Encoded(rendition string, d time.Duration, err error) {}
+func (m *fakeMetrics) Uploaded(bytes int64, d time.Duration, err error)     {}
+func (m *fakeMetrics) Retried(op string)                                    {}
+
+// nopLogger drops all entries
+type nopLogger struct{}
+
+func (nopLogger) Debug(msg string, fields ...domain.Field)    {}
+func (nopLogger) Info(msg string, fields ...domain.Field)     {}
+func (nopLogger) Warn(msg string, fields ...domain.Field)     {}
+func (nopLogger) Error(msg string, fields ...domain.Field)    {}
+func (l nopLogger) With(fields ...domain.Field) domain.Logger { return l }
+
+// testRenditions is a ladder with a preview and an HEVC variant
+var testRenditions = []domain.Rendition{
+	{Name: "720", Height: 720, Property: "LINK_720"},
+	{Name: "360", Height: 360, Property: "LINK_360"},
+	{Name: "720-hevc", Height: 720, Variant: "hevc", Property: "LINK_720_HEVC"},
+	{Name: "360-hevc", Height: 360, Variant: "hevc", Property: "LINK_360_HEVC"},
+	{Name: "preview", Preview: true, Property: "LINK_PREVIEW"},
+}
+
+// testCase is a VideoCase with fakes
+type testCase struct {
+	*VideoCase
+	db      *fakeStorage
+	jobs    *fakeJobs
+	encoder *fakeEncoder
+	cloud   *fakeCloud
+	metrics *fakeMetrics
+}
+
+// newTestCase returns a VideoCase of renditions rr and packaging p which works with fakes,
+// its temp dir is removed by the end of the test
+func newTestCase(t *testing.T, rr []domain.Rendition, p domain.Packaging, videos ...*domain.Video) *testCase {
+	tc := &testCase{
+		db:      newFakeStorage(videos...),
+		jobs:    newFakeJobs(),
+		encoder: &fakeEncoder{},
+		cloud:   newFakeCloud(),
+		metrics: &fakeMetrics{},
+	}
+
+	limits := domain.Limits{Videos: 1, Downloads: 1, Encodes: 1, Uploads: 1}
+	tc.VideoCase = NewVideoCase(make(chan struct{}, 1), domain.EnvDebug, t.TempDir(), false, false, false, rr, p, false, limits, domain.EncodeTimeouts{}, tc.db, tc.jobs, tc.cloud, tc.encoder, tc.metrics, nopLogger{})
+
+	return tc
+}
@@ -0,0 +1,170 @@
+package interactor
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"strconv"
+	"time"
+	"videoconverter/domain"
+)
+
+// CheckForce checks that formats of f are configured renditions or enabled packaging formats
+func (vc *VideoCase) CheckForce(f domain.Force) error {
+	names := append(domain.RenditionNames(vc.renditions), packageJobs(vc.packaging)...)
+
+	for _, n := range f.Names {
+		if !contains(names, n) {
+			return errors.Wrap(ErrUnknownRendition, n)
+		}
+	}
+
+	return nil
+}
+
+// formats returns renditions and packaging formats which video v needs, isResumed allows to process
+// an interrupted video which has some formats. Formats of force are made again even if v has them
+// or missing formats of v are skipped, forced are their names and cloud names of made formats get a new version then.
+func (vc *VideoCase) formats(v *domain.Video, isResumed bool, force domain.Force) (rr []domain.Rendition, p domain.Packaging, forced []string, err error) {
+	if force.IsEmpty() {
+		if err := vc.prepare(v, isResumed); err != nil {
+			return nil, p, nil, err
+		}
+
+		return v.Missing(vc.renditions), vc.missingPackaging(v), nil, nil
+	}
+
+	skipErr := vc.skip(v, isResumed)
+
+	p = vc.missingPackaging(v)
+	if skipErr != nil {
+		p.HLS, p.DASH = false, false
+	}
+
+	for _, r := range vc.renditions {
+		switch {
+		case force.Has(r.Name):
+			rr = append(rr, r)
+
+			if v.Link(r.Property) != "" {
+				forced = append(forced, r.Name)
+			}
+		case skipErr == nil && v.Link(r.Property) == "":
+			rr = append(rr, r)
+		}
+	}
+
+	if vc.packaging.HLS && !p.HLS && force.Has(jobHLS) {
+		p.HLS = true
+
+		if v.Link(vc.packaging.HLSProperty) != "" {
+			forced = append(forced, jobHLS)
+		}
+	}
+
+	if vc.packaging.DASH && !p.DASH && force.Has(jobDASH) {
+		p.DASH = true
+
+		if v.Link(vc.packaging.DASHProperty) != "" {
+			forced = append(forced, jobDASH)
+		}
+	}
+
+	if len(rr) == 0 && !p.IsEnabled() {
+		vc.l.Debug("video has no formats to make, skipping", domain.VideoID(v.ID))
+
+		if skipErr == nil {
+			skipErr = errFull
+		}
+
+		return nil, p, nil, skipErr
+	}
+
+	if err := vc.locate(v); err != nil {
+		return nil, p, nil, err
+	}
+
+	if len(forced) > 0 {
+		v.Version = newVersion()
+	}
+
+	return rr, p, forced, nil
+}
+
+// newVersion returns a version of cloud names of formats made again
+func newVersion() string {
+	return strconv.FormatInt(time.Now().Unix(), 10)
+}
+
+// saveLink saves link to the format with code of video v. An existing link is replaced in one update
+// only if nobody has changed it since the video was read, otherwise ErrLinkChanged is returned.
+func (vc *VideoCase) saveLink(ctx context.Context, v *domain.Video, code, link string) error {
+	old := v.Link(code)
+	if old == "" || old == link {
+		return vc.db.SetLink(v, code, link)
+	}
+
+	if err := vc.db.ReplaceLink(v, code, old, link); err != nil {
+		if errors.Cause(err) == domain.ErrLinkChanged {
+			vc.log(ctx).Warn("uploaded file isn't linked and is left in the cloud", domain.F("url", link))
+		}
+
+		return err
+	}
+
+	vc.log(ctx).Info("link is replaced", domain.Stage(domain.StageSave), domain.F("old", old), domain.F("url", link))
+
+	return nil
+}
+
+// isFatal checks that err of saving a link is a database failure which stops the program
+func isFatal(err error) bool {
+	return errors.Cause(err) != domain.ErrLinkChanged
+}
+
+// removeReplaced removes cloud files of links of video v which were replaced since links before,
+// a file is kept if another format still links to it. Old packages are kept because only single files are removed.
+func (vc *VideoCase) removeReplaced(ctx context.Context, v *domain.Video, before map[string]string) {
+	l := vc.log(ctx)
+	links := v.Links()
+
+	linked := make(map[string]bool, len(links))
+	for _, link := range links {
+		linked[link] = true
+	}
+
+	packages := vc.packaging.Codes()
+
+	for code, old := range before {
+		if links[code] == old || linked[old] {
+			continue
+		}
+
+		if contains(packages, code) {
+			l.Info("replaced package is kept in the cloud", domain.Stage(domain.StageCleanup), domain.F("url", old))
+			continue
+		}
+
+		cloudPath, err := vc.cloud.Path(old)
+		if err == nil {
+			err = vc.cloud.Delete(ctx, cloudPath)
+		}
+
+		if err != nil {
+			l.Error("can't remove replaced file", domain.Stage(domain.StageCleanup), domain.F("url", old), domain.Err(err))
+			continue
+		}
+
+		l.Info("replaced file is removed", domain.Stage(domain.StageCleanup), domain.F("url", old))
+	}
+}
+
+// contains checks that ss contains s
+func contains(ss []string, s string) bool {
+	for _, i := range ss {
+		if i == s {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,179 @@
+package interactor
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"reflect"
+	"testing"
+	"videoconverter/domain"
+)
+
+// allLinks returns links to all renditions of testRenditions
+func allLinks() map[string]string {
+	links := make(map[string]string)
+	for _, r := range testRenditions {
+		links[r.Property] = cloudURL + "videos/" + r.Name + ".mp4"
+	}
+
+	return links
+}
+
+func TestCheckForce(t *testing.T) {
+	vc := newTestCase(t, testRenditions, domain.Packaging{HLS: true, HLSProperty: "LINK_HLS"})
+
+	tests := []struct {
+		name    string
+		f       domain.Force
+		wantErr error
+	}{
+		{name: "empty"},
+		{name: "all", f: domain.Force{All: true}},
+		{name: "renditions and hls", f: domain.Force{Names: []string{"720", "360-hevc", "hls"}}},
+		{name: "unknown rendition", f: domain.Force{Names: []string{"1080"}}, wantErr: ErrUnknownRendition},
+		{name: "disabled packaging", f: domain.Force{Names: []string{"dash"}}, wantErr: ErrUnknownRendition},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := vc.CheckForce(tt.f); errors.Cause(err) != tt.wantErr {
+				t.Errorf("CheckForce() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestFormats(t *testing.T) {
+	partial := map[string]string{"LINK_720": cloudURL + "videos/720.mp4"}
+
+	tests := []struct {
+		name        string
+		links       map[string]string
+		skipNotFull bool
+		isResumed   bool
+		force       domain.Force
+		want        []string
+		wantForced  []string
+		wantVersion bool
+		wantErr     error
+	}{
+		{
+			name:    "full video",
+			links:   allLinks(),
+			wantErr: errFull,
+		},
+		{
+			name:  "missing formats",
+			links: partial,
+			want:  []string{"360", "720-hevc", "360-hevc", "preview"},
+		},
+		{
+			name:        "skip not full",
+			links:       partial,
+			skipNotFull: true,
+			wantErr:     errHasFormats,
+		},
+		{
+			name:        "resumed video isn't skipped",
+			links:       partial,
+			skipNotFull: true,
+			isResumed:   true,
+			want:        []string{"360", "720-hevc", "360-hevc", "preview"},
+		},
+		{
+			name:        "forced format of a full video",
+			links:       allLinks(),
+			force:       domain.Force{Names: []string{"720"}},
+			want:        []string{"720"},
+			wantForced:  []string{"720"},
+			wantVersion: true,
+		},
+		{
+			name:        "forced format of a skipped video",
+			links:       partial,
+			skipNotFull: true,
+			force:       domain.Force{Names: []string{"360"}},
+			want:        []string{"360"},
+		},
+		{
+			name:  "forced missing formats are made with other missing ones",
+			links: partial,
+			force: domain.Force{Names: []string{"360"}},
+			want:  []string{"360", "720-hevc", "360-hevc", "preview"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vc := newTestCase(t, testRenditions, domain.Packaging{})
+			vc.skipNotFull = tt.skipNotFull
+			v := newVideo(1, tt.links)
+
+			rr, _, forced, err := vc.formats(v, tt.isResumed, tt.force)
+			if errors.Cause(err) != tt.wantErr {
+				t.Fatalf("formats() error = %v, want %v", err, tt.wantErr)
+			}
+
+			if err != nil {
+				return
+			}
+
+			if got := domain.RenditionNames(rr); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("formats() renditions = %v, want %v", got, tt.want)
+			}
+
+			if !reflect.DeepEqual(forced, tt.wantForced) {
+				t.Errorf("formats() forced = %v, want %v", forced, tt.wantForced)
+			}
+
+			if got := v.Version != ""; got != tt.wantVersion {
+				t.Errorf("formats() version = %q, want a new one %v", v.Version, tt.wantVersion)
+			}
+		})
+	}
+}
+
+func TestSaveLink(t *testing.T) {
+	const old = cloudURL + "videos/720.mp4"
+	const link = cloudURL + "videos/720-v2.mp4"
+
+	tests := []struct {
+		name    string
+		saved   string
+		read    string
+		want    string
+		wantErr error
+	}{
+		{name: "new link", want: link},
+		{name: "replaced link", saved: old, read: old, want: link},
+		{name: "link changed by somebody", saved: cloudURL + "other.mp4", read: old, want: cloudURL + "other.mp4", wantErr: domain.ErrLinkChanged},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			saved := map[string]string{}
+			if tt.saved != "" {
+				saved["LINK_720"] = tt.saved
+			}
+
+			vc := newTestCase(t, testRenditions, domain.Packaging{}, newVideo(1, saved))
+
+			read := map[string]string{}
+			if tt.read != "" {
+				read["LINK_720"] = tt.read
+			}
+
+			err := vc.saveLink(context.Background(), newVideo(1, read), "LINK_720", link)
+			if errors.Cause(err) != tt.wantErr {
+				t.Fatalf("saveLink() error = %v, want %v", err, tt.wantErr)
+			}
+
+			if err != nil && isFatal(err) {
+				t.Errorf("saveLink() error %v is fatal", err)
+			}
+
+			if got := vc.db.link(1, "LINK_720"); got != tt.want {
+				t.Errorf("saveLink() saved %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,127 @@
+package interactor
+
+import (
+	"github.com/pkg/errors"
+	"videoconverter/domain"
+)
+
+// Names of jobs for adaptive streaming formats
+const (
+	jobHLS  = "hls"
+	jobDASH = "dash"
+)
+
+// setState saves a state of the rendition of a video into the job store,
+// err is saved as a description of failed state. Jobs failed because of a shutdown are saved as interrupted.
+// Errors of the job store are only logged, they shouldn't stop processing.
+func (vc *VideoCase) setState(videoID int64, rendition string, state domain.JobState, err error) {
+	if state == domain.JobFailed && vc.work != nil && vc.work.Err() != nil {
+		state = domain.JobInterrupted
+	}
+
+	var msg string
+	if err != nil {
+		msg = err.Error()
+	}
+
+	if err := vc.jobs.SetState(videoID, rendition, state, msg); err != nil {
+		vc.l.Error("can't save job state", domain.VideoID(videoID), domain.Quality(rendition), domain.F("state", state), domain.Err(err))
+	}
+}
+
+// packageJobs returns names of jobs for adaptive streaming formats enabled in p
+func packageJobs(p domain.Packaging) []string {
+	var names []string
+
+	if p.HLS {
+		names = append(names, jobHLS)
+	}
+
+	if p.DASH {
+		names = append(names, jobDASH)
+	}
+
+	return names
+}
+
+// resumable returns ids of videos which processing was interrupted by a crash or a shutdown
+func (vc *VideoCase) resumable() map[int64]bool {
+	jobs, err := vc.jobs.Unfinished()
+	if err != nil {
+		vc.l.Error("can't get unfinished jobs", domain.Err(err))
+		return nil
+	}
+
+	ids := make(map[int64]bool, len(jobs))
+	for _, j := range jobs {
+		ids[j.VideoID] = true
+	}
+
+	return ids
+}
+
+// videoJob returns the job of the whole video with id, nil if there is no one
+func (vc *VideoCase) videoJob(id int64) *domain.Job {
+	jobs, err := vc.jobs.Jobs(id)
+	if err != nil {
+		vc.l.Error("can't get jobs", domain.VideoID(id), domain.Err(err))
+		return nil
+	}
+
+	for i, j := range jobs {
+		if j.Rendition == "" {
+			return &jobs[i]
+		}
+	}
+
+	return nil
+}
+
+// unqueue returns video with id which wasn't taken by a worker to the state of its job prev,
+// a video which had no job is marked as failed because the queue is full
+func (vc *VideoCase) unqueue(id int64, prev *domain.Job) {
+	if prev == nil {
+		vc.setState(id, "", domain.JobFailed, ErrQueueFull)
+		return
+	}
+
+	if err := vc.jobs.SetState(id, "", prev.State, prev.Error); err != nil {
+		vc.l.Error("can't save job state", domain.VideoID(id), domain.F("state", prev.State), domain.Err(err))
+	}
+}
+
+// closeJobs finishes unfinished jobs of a resumed video with id which isn't processed again because of err,
+// jobs of a video which has all formats are done, other ones are failed with err
+func (vc *VideoCase) closeJobs(id int64, err error) {
+	state := domain.JobFailed
+	if errors.Is(err, errFull) || errors.Is(err, ErrNothingToDo) {
+		state, err = domain.JobDone, nil
+	}
+
+	jobs, jErr := vc.jobs.Jobs(id)
+	if jErr != nil {
+		vc.l.Error("can't get jobs", domain.VideoID(id), domain.Err(jErr))
+		return
+	}
+
+	for _, j := range jobs {
+		if !j.State.IsFinal() {
+			vc.setState(id, j.Rendition, state, err)
+		}
+	}
+}
+
+// cancelJobs marks all not done jobs of video with id as canceled
+func (vc *VideoCase) cancelJobs(id int64) {
+	jobs, err := vc.jobs.Jobs(id)
+	if err != nil {
+		vc.l.Error("can't get jobs", domain.VideoID(id), domain.Err(err))
+		return
+	}
+
+	for _, j := range jobs {
+		if j.State != domain.JobDone {
+			vc.setState(id, j.Rendition, domain.JobCanceled, nil)
+		}
+	}
+}
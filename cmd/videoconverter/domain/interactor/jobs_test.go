@@ -0,0 +1,71 @@
+package interactor
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"testing"
+	"videoconverter/domain"
+)
+
+func TestSetState(t *testing.T) {
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		name  string
+		work  context.Context
+		state domain.JobState
+		want  domain.JobState
+	}{
+		{name: "failed", state: domain.JobFailed, want: domain.JobFailed},
+		{name: "failed while working", work: context.Background(), state: domain.JobFailed, want: domain.JobFailed},
+		{name: "failed by a shutdown", work: canceled, state: domain.JobFailed, want: domain.JobInterrupted},
+		{name: "done after a shutdown", work: canceled, state: domain.JobDone, want: domain.JobDone},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vc := newTestCase(t, testRenditions, domain.Packaging{})
+			vc.work = tt.work
+
+			vc.setState(1, "720", tt.state, errors.New("ffmpeg failed"))
+
+			if got := vc.jobs.state(1, "720"); got != tt.want {
+				t.Errorf("setState() saved %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStartFinishesResumedJobs(t *testing.T) {
+	empty := newVideo(2, nil)
+	empty.LinkOrig.String = ""
+
+	vc := newTestCase(t, testRenditions, domain.Packaging{}, newVideo(1, allLinks()), empty)
+	for _, id := range []int64{1, 2} {
+		vc.jobs.SetState(id, "", domain.JobInterrupted, "")
+		vc.jobs.SetState(id, "720", domain.JobQueued, "")
+	}
+
+	vc.Start(context.Background(), context.Background(), domain.VideoFilter{}, domain.Force{})
+
+	tests := []struct {
+		id   int64
+		want domain.JobState
+	}{
+		{id: 1, want: domain.JobDone},
+		{id: 2, want: domain.JobFailed},
+	}
+
+	for _, tt := range tests {
+		for _, rendition := range []string{"", "720"} {
+			if got := vc.jobs.state(tt.id, rendition); got != tt.want {
+				t.Errorf("Start() video %d job %q = %q, want %q", tt.id, rendition, got, tt.want)
+			}
+		}
+	}
+
+	if jobs, _ := vc.jobs.Unfinished(); len(jobs) > 0 {
+		t.Errorf("Start() left unfinished jobs %v", jobs)
+	}
+}
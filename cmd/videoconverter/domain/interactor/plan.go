@@ -0,0 +1,64 @@
+package interactor
+
+import (
+	"videoconverter/domain"
+)
+
+// Plan returns what Start would do with every video selected by f and formats of force in the order of processing,
+// it applies the same checks but doesn't download, encode or write anything
+func (vc *VideoCase) Plan(f domain.VideoFilter, force domain.Force) ([]domain.PlanItem, error) {
+	videos, err := vc.videos(f)
+	if err != nil {
+		return nil, err
+	}
+
+	resume := vc.resumeFirst(videos)
+	plan := make([]domain.PlanItem, 0, len(videos))
+
+	for i := range videos {
+		v := &videos[i]
+		item := domain.PlanItem{VideoID: v.ID, Action: domain.PlanProcess, Resumed: resume[v.ID], Missing: []string{}}
+
+		rr, p, forced, err := vc.formats(v, resume[v.ID] || f.IsRequested(v.ID), force)
+		if err != nil {
+			item.Action = domain.PlanSkip
+			item.Reason = err.Error()
+			plan = append(plan, item)
+
+			continue
+		}
+
+		item.Forced = forced
+		item.Missing = append(domain.RenditionNames(rr), packageJobs(p)...)
+		item.Encodes = vc.runs(rr, p)
+		plan = append(plan, item)
+	}
+
+	return plan, nil
+}
+
+// runs returns a max number of ffmpeg runs which make renditions rr and packaging formats p,
+// renditions of the main ladder which aren't in rr are encoded again for packaging
+func (vc *VideoCase) runs(rr []domain.Rendition, p domain.Packaging) int {
+	n := len(rr)
+	if vc.singlePass && n > 1 {
+		n = 1
+	}
+
+	if !p.IsEnabled() {
+		return n
+	}
+
+	made := make(map[string]bool, len(rr))
+	for _, r := range rr {
+		made[r.Name] = true
+	}
+
+	for _, r := range vc.renditions {
+		if !r.Preview && r.Variant == "" && !made[r.Name] {
+			n++
+		}
+	}
+
+	return n + 1
+}
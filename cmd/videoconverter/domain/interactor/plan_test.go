@@ -0,0 +1,80 @@
+package interactor
+
+import (
+	"reflect"
+	"testing"
+	"videoconverter/domain"
+)
+
+func TestPlan(t *testing.T) {
+	partial := map[string]string{"LINK_720": cloudURL + "videos/720.mp4"}
+
+	empty := newVideo(3, nil)
+	empty.LinkOrig.String = ""
+
+	p := domain.Packaging{HLS: true, HLSProperty: "LINK_HLS"}
+	full := allLinks()
+	full["LINK_HLS"] = cloudURL + "videos/stream/master.m3u8"
+
+	vc := newTestCase(t, testRenditions, p, newVideo(1, full), newVideo(2, partial), empty, newVideo(4, partial))
+	vc.skipNotFull = true
+	vc.jobs.SetState(4, "", domain.JobInterrupted, "")
+
+	plan, err := vc.Plan(domain.VideoFilter{}, domain.Force{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []domain.PlanItem{
+		{
+			VideoID: 4,
+			Action:  domain.PlanProcess,
+			Resumed: true,
+			Missing: []string{"360", "720-hevc", "360-hevc", "preview", "hls"},
+			// 4 renditions, 720 encoded again for packaging and the packaging itself
+			Encodes: 6,
+		},
+		{VideoID: 1, Action: domain.PlanSkip, Reason: errFull.Error(), Missing: []string{}},
+		{VideoID: 2, Action: domain.PlanSkip, Reason: errHasFormats.Error(), Missing: []string{}},
+		{VideoID: 3, Action: domain.PlanSkip, Reason: ErrEmptyOriginal.Error(), Missing: []string{}},
+	}
+
+	if !reflect.DeepEqual(plan, want) {
+		t.Errorf("Plan() = %+v, want %+v", plan, want)
+	}
+
+	if got := vc.jobs.state(4, ""); got != domain.JobInterrupted {
+		t.Errorf("Plan() changed the job of a resumed video to %q", got)
+	}
+
+	if got := vc.db.link(4, "LINK_360"); got != "" {
+		t.Errorf("Plan() saved a link %q", got)
+	}
+}
+
+func TestPlanRuns(t *testing.T) {
+	rr := testRenditions[:2]
+
+	tests := []struct {
+		name       string
+		singlePass bool
+		p          domain.Packaging
+		want       int
+	}{
+		{name: "one run per rendition", want: 2},
+		{name: "single pass", singlePass: true, want: 1},
+		{name: "packaging", p: domain.Packaging{DASH: true}, want: 3},
+		{name: "single pass and packaging", singlePass: true, p: domain.Packaging{HLS: true}, want: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vc := newTestCase(t, testRenditions, tt.p)
+			vc.singlePass = tt.singlePass
+
+			if got := vc.runs(rr, tt.p); got != tt.want {
+				t.Errorf("runs() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
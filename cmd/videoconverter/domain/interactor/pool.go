@@ -0,0 +1,23 @@
+package interactor
+
+// semaphore limits a number of concurrent operations
+type semaphore chan struct{}
+
+// newSemaphore returns a semaphore which allows n concurrent operations
+func newSemaphore(n int) semaphore {
+	if n < 1 {
+		n = 1
+	}
+
+	return make(semaphore, n)
+}
+
+// acquire blocks until a free slot is available
+func (s semaphore) acquire() {
+	s <- struct{}{}
+}
+
+// release frees a slot taken by acquire
+func (s semaphore) release() {
+	<-s
+}
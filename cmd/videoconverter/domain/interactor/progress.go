@@ -0,0 +1,59 @@
+package interactor
+
+import (
+	"context"
+	"math"
+	"time"
+	"videoconverter/domain"
+)
+
+// progressLogInterval is a min interval between log entries about progress of one ffmpeg process
+const progressLogInterval = 10 * time.Second
+
+// withProgress returns a copy of ctx which reports progress of an ffmpeg process making jobs of video with id
+// into the log and, in the server mode, to the status API
+func (vc *VideoCase) withProgress(ctx context.Context, id int64, jobs ...string) context.Context {
+	l := vc.log(ctx)
+
+	var logged time.Time
+
+	return domain.WithProgress(ctx, func(p domain.Progress) {
+		vc.mu.Lock()
+		if a, ok := vc.active[id]; ok {
+			for _, j := range jobs {
+				a.progress[j] = p
+			}
+		}
+		vc.mu.Unlock()
+
+		if time.Since(logged) < progressLogInterval || p.Percent == 100 {
+			return
+		}
+
+		logged = time.Now()
+
+		l.Info("encoding progress",
+			domain.F("percent", math.Round(p.Percent*10)/10),
+			domain.F("fps", p.FPS),
+			domain.F("speed", p.Speed),
+			domain.F("eta_ms", p.ETA.Milliseconds()),
+		)
+	})
+}
+
+// Progress returns progress of running ffmpeg processes of video with id by job names,
+// it's empty if the video isn't processed in the server mode
+func (vc *VideoCase) Progress(id int64) map[string]domain.Progress {
+	vc.mu.Lock()
+	defer vc.mu.Unlock()
+
+	progress := make(map[string]domain.Progress)
+
+	if a, ok := vc.active[id]; ok {
+		for j, p := range a.progress {
+			progress[j] = p
+		}
+	}
+
+	return progress
+}
@@ -0,0 +1,215 @@
+package interactor
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"sync"
+	"videoconverter/domain"
+)
+
+// queueSize is a number of videos which can wait for a worker in the server mode
+const queueSize = 100
+
+var (
+	ErrNotServing       = errors.New("обработка видео не запущена")
+	ErrQueueFull        = errors.New("очередь видео заполнена")
+	ErrBusy             = errors.New("видео уже в очереди или обрабатывается")
+	ErrNotActive        = errors.New("видео не в очереди и не обрабатывается")
+	ErrNothingToDo      = errors.New("видео не требует обработки")
+	ErrEmptyOriginal    = errors.New("видео имеет пустую ссылку на оригинал")
+	ErrUnknownRendition = errors.New("неизвестный формат")
+)
+
+// activeVideo describe a video queued or processed in the server mode
+type activeVideo struct {
+	cancel   context.CancelFunc
+	canceled bool
+	// progress is the last progress of running ffmpeg processes by job names
+	progress map[string]domain.Progress
+}
+
+// Serve processes videos enqueued by Enqueue and Rerun until ctx is done, running videos
+// are interrupted when work is done. Videos interrupted by a crash or a shutdown are enqueued first.
+// It returns when all workers are stopped.
+func (vc *VideoCase) Serve(ctx, work context.Context) {
+	queue := make(chan task, queueSize)
+
+	vc.mu.Lock()
+	vc.intake, vc.work = ctx, work
+	vc.queue = queue
+	vc.mu.Unlock()
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < vc.limits.Videos; i++ {
+		wg.Add(1)
+		go vc.worker(&wg, queue)
+	}
+
+	for id := range vc.resumable() {
+		err := vc.Enqueue(id)
+		if err == nil {
+			continue
+		}
+
+		vc.l.Warn("can't resume video", domain.VideoID(id), domain.Err(err))
+
+		// a video which didn't fit into the queue keeps its state and is resumed at the next start
+		if !errors.Is(err, ErrQueueFull) {
+			vc.closeJobs(id, err)
+		}
+	}
+
+	<-ctx.Done()
+
+	vc.mu.Lock()
+	vc.queue = nil
+	close(queue)
+	vc.mu.Unlock()
+
+	wg.Wait()
+
+	vc.cleanTemp()
+}
+
+// Enqueue queues video with id for making all its missing formats,
+// SKIP_NOT_FULL isn't applied to videos requested explicitly
+func (vc *VideoCase) Enqueue(id int64) error {
+	v, err := vc.db.Video(id)
+	if err != nil {
+		return err
+	}
+
+	if err := vc.prepare(v, true); err != nil {
+		if err == errFull {
+			return errors.WithStack(ErrNothingToDo)
+		}
+
+		return err
+	}
+
+	return vc.push(v, v.Missing(vc.renditions), vc.missingPackaging(v))
+}
+
+// Rerun queues video with id for making the format name again even if it's already made,
+// name is a rendition name or "hls" or "dash". A made format gets a new cloud name and its link is replaced.
+func (vc *VideoCase) Rerun(id int64, name string) error {
+	var rr []domain.Rendition
+	var p domain.Packaging
+
+	switch {
+	case name == jobHLS && vc.packaging.HLS:
+		p = vc.packaging
+		p.DASH = false
+	case name == jobDASH && vc.packaging.DASH:
+		p = vc.packaging
+		p.HLS = false
+	default:
+		for _, r := range vc.renditions {
+			if r.Name == name {
+				rr = append(rr, r)
+			}
+		}
+
+		if len(rr) == 0 {
+			return errors.Wrap(ErrUnknownRendition, name)
+		}
+	}
+
+	v, err := vc.db.Video(id)
+	if err != nil {
+		return err
+	}
+
+	if err := vc.locate(v); err != nil {
+		return err
+	}
+
+	for _, code := range append(domain.PropertyCodes(rr), p.Codes()...) {
+		if v.Link(code) != "" {
+			v.Version = newVersion()
+		}
+	}
+
+	return vc.push(v, rr, p)
+}
+
+// Cancel stops processing of video with id, it's removed from the queue if it's waiting
+func (vc *VideoCase) Cancel(id int64) error {
+	vc.mu.Lock()
+	defer vc.mu.Unlock()
+
+	a, ok := vc.active[id]
+	if !ok {
+		return errors.WithStack(ErrNotActive)
+	}
+
+	vc.l.Info("canceling video", domain.VideoID(id))
+
+	a.canceled = true
+	a.cancel()
+
+	return nil
+}
+
+// push queues video v for making renditions rr and packaging formats p
+func (vc *VideoCase) push(v *domain.Video, rr []domain.Rendition, p domain.Packaging) error {
+	prev := vc.videoJob(v.ID)
+
+	vc.mu.Lock()
+
+	if vc.queue == nil {
+		vc.mu.Unlock()
+		return errors.WithStack(ErrNotServing)
+	}
+
+	if _, ok := vc.active[v.ID]; ok {
+		vc.mu.Unlock()
+		return errors.WithStack(ErrBusy)
+	}
+
+	ctx, cancel := context.WithCancel(vc.work)
+	vc.active[v.ID] = &activeVideo{cancel: cancel, progress: make(map[string]domain.Progress)}
+
+	// a worker takes the video right after sending, so it's counted as queued before
+	vc.setState(v.ID, "", domain.JobQueued, nil)
+	vc.metrics.Queued(1)
+
+	select {
+	case vc.queue <- task{ctx, v, rr, p}:
+	default:
+		delete(vc.active, v.ID)
+		vc.mu.Unlock()
+
+		cancel()
+		vc.metrics.Queued(-1)
+		vc.unqueue(v.ID, prev)
+
+		return errors.WithStack(ErrQueueFull)
+	}
+
+	vc.mu.Unlock()
+
+	vc.l.Info("video queued", domain.VideoID(v.ID))
+	vc.metrics.VideosFound(1)
+
+	return nil
+}
+
+// finish forgets a processed video with id, jobs of a canceled video are marked as canceled
+func (vc *VideoCase) finish(id int64) {
+	vc.mu.Lock()
+	a, ok := vc.active[id]
+	delete(vc.active, id)
+	vc.mu.Unlock()
+
+	if !ok {
+		return
+	}
+
+	a.cancel()
+
+	if a.canceled {
+		vc.cancelJobs(id)
+	}
+}
@@ -0,0 +1,214 @@
+package interactor
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"reflect"
+	"testing"
+	"videoconverter/domain"
+)
+
+// serve makes vc accept videos into a queue of size without workers
+func serve(vc *testCase, size int) chan task {
+	queue := make(chan task, size)
+	vc.work = context.Background()
+	vc.queue = queue
+
+	return queue
+}
+
+func TestEnqueue(t *testing.T) {
+	partial := map[string]string{"LINK_720": cloudURL + "videos/720.mp4"}
+
+	vc := newTestCase(t, testRenditions, domain.Packaging{}, newVideo(1, allLinks()), newVideo(2, partial))
+
+	if err := vc.Enqueue(2); errors.Cause(err) != ErrNotServing {
+		t.Fatalf("Enqueue() before serving error = %v, want %v", err, ErrNotServing)
+	}
+
+	queue := serve(vc, 1)
+
+	if err := vc.Enqueue(1); errors.Cause(err) != ErrNothingToDo {
+		t.Errorf("Enqueue() of a full video error = %v, want %v", err, ErrNothingToDo)
+	}
+
+	if err := vc.Enqueue(2); err != nil {
+		t.Fatalf("Enqueue() error = %v", err)
+	}
+
+	if err := vc.Enqueue(2); errors.Cause(err) != ErrBusy {
+		t.Errorf("Enqueue() of a queued video error = %v, want %v", err, ErrBusy)
+	}
+
+	task := <-queue
+	if got := len(task.rr); got != 4 {
+		t.Errorf("Enqueue() queued %d renditions, want 4 missing ones", got)
+	}
+
+	if got := vc.jobs.state(2, ""); got != domain.JobQueued {
+		t.Errorf("Enqueue() video job = %q, want %q", got, domain.JobQueued)
+	}
+
+	if vc.metrics.queued != 1 {
+		t.Errorf("Enqueue() queued metric = %d, want 1", vc.metrics.queued)
+	}
+}
+
+func TestPushIsQueuedBeforeWorker(t *testing.T) {
+	vc := newTestCase(t, testRenditions, domain.Packaging{}, newVideo(1, nil))
+	queue := serve(vc, 0)
+
+	// a worker sees the video queued when it takes it
+	taken := make(chan domain.JobState)
+	go func() {
+		<-queue
+		vc.metrics.Queued(-1)
+		taken <- vc.jobs.state(1, "")
+	}()
+
+	// push doesn't wait for a worker, so it's repeated until the worker is ready
+	for {
+		err := vc.Enqueue(1)
+		if err == nil {
+			break
+		}
+
+		if errors.Cause(err) != ErrQueueFull {
+			t.Fatalf("Enqueue() error = %v", err)
+		}
+	}
+
+	if got := <-taken; got != domain.JobQueued {
+		t.Errorf("worker took a video in state %q, want %q", got, domain.JobQueued)
+	}
+
+	if vc.metrics.queued != 0 {
+		t.Errorf("queued metric = %d, want 0 after the worker took the video", vc.metrics.queued)
+	}
+}
+
+func TestPushQueueFull(t *testing.T) {
+	tests := []struct {
+		name string
+		prev *domain.Job
+		want domain.JobState
+	}{
+		{name: "new video", want: domain.JobFailed},
+		{name: "done video", prev: &domain.Job{VideoID: 1, State: domain.JobDone}, want: domain.JobDone},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vc := newTestCase(t, testRenditions, domain.Packaging{}, newVideo(1, nil))
+			serve(vc, 0)
+
+			if tt.prev != nil {
+				vc.jobs.SetState(tt.prev.VideoID, "", tt.prev.State, "")
+			}
+
+			if err := vc.Enqueue(1); errors.Cause(err) != ErrQueueFull {
+				t.Fatalf("Enqueue() error = %v, want %v", err, ErrQueueFull)
+			}
+
+			if got := vc.jobs.state(1, ""); got != tt.want {
+				t.Errorf("Enqueue() left the video job %q, want %q", got, tt.want)
+			}
+
+			if vc.metrics.queued != 0 {
+				t.Errorf("queued metric = %d, want 0", vc.metrics.queued)
+			}
+
+			if err := vc.Cancel(1); errors.Cause(err) != ErrNotActive {
+				t.Errorf("Cancel() error = %v, the video is still active", err)
+			}
+		})
+	}
+}
+
+func TestRerun(t *testing.T) {
+	p := domain.Packaging{HLS: true, HLSProperty: "LINK_HLS"}
+	links := allLinks()
+	links["LINK_HLS"] = cloudURL + "videos/stream/master.m3u8"
+
+	tests := []struct {
+		name        string
+		format      string
+		wantRR      []string
+		wantHLS     bool
+		wantErr     error
+		wantVersion bool
+	}{
+		{name: "rendition", format: "720", wantRR: []string{"720"}, wantVersion: true},
+		{name: "packaging", format: "hls", wantRR: []string{}, wantHLS: true, wantVersion: true},
+		{name: "disabled packaging", format: "dash", wantErr: ErrUnknownRendition},
+		{name: "unknown rendition", format: "1080", wantErr: ErrUnknownRendition},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vc := newTestCase(t, testRenditions, p, newVideo(1, links))
+			queue := serve(vc, 1)
+
+			err := vc.Rerun(1, tt.format)
+			if errors.Cause(err) != tt.wantErr {
+				t.Fatalf("Rerun() error = %v, want %v", err, tt.wantErr)
+			}
+
+			if err != nil {
+				return
+			}
+
+			task := <-queue
+
+			if got := domain.RenditionNames(task.rr); !reflect.DeepEqual(got, tt.wantRR) {
+				t.Errorf("Rerun() renditions = %v, want %v", got, tt.wantRR)
+			}
+
+			if task.p.HLS != tt.wantHLS || task.p.DASH {
+				t.Errorf("Rerun() packaging = %+v, want HLS %v", task.p, tt.wantHLS)
+			}
+
+			if got := task.v.Version != ""; got != tt.wantVersion {
+				t.Errorf("Rerun() version = %q, want a new one %v", task.v.Version, tt.wantVersion)
+			}
+		})
+	}
+}
+
+func TestCancel(t *testing.T) {
+	vc := newTestCase(t, testRenditions, domain.Packaging{}, newVideo(1, nil))
+	queue := serve(vc, 1)
+
+	if err := vc.Cancel(1); errors.Cause(err) != ErrNotActive {
+		t.Errorf("Cancel() of an unknown video error = %v, want %v", err, ErrNotActive)
+	}
+
+	if err := vc.Enqueue(1); err != nil {
+		t.Fatal(err)
+	}
+
+	task := <-queue
+	vc.setState(1, "720", domain.JobDone, nil)
+	vc.setState(1, "360", domain.JobEncoding, nil)
+
+	if err := vc.Cancel(1); err != nil {
+		t.Fatalf("Cancel() error = %v", err)
+	}
+
+	if task.ctx.Err() == nil {
+		t.Error("Cancel() didn't cancel the context of the video")
+	}
+
+	vc.finish(1)
+
+	want := map[string]domain.JobState{"": domain.JobCanceled, "720": domain.JobDone, "360": domain.JobCanceled}
+	for rendition, state := range want {
+		if got := vc.jobs.state(1, rendition); got != state {
+			t.Errorf("job %q = %q, want %q", rendition, got, state)
+		}
+	}
+
+	if err := vc.Cancel(1); errors.Cause(err) != ErrNotActive {
+		t.Errorf("Cancel() of a finished video error = %v, want %v", err, ErrNotActive)
+	}
+}
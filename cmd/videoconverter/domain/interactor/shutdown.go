@@ -0,0 +1,54 @@
+package interactor
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"videoconverter/domain"
+)
+
+// cleanTemp removes everything left in the temp dir after all workers are stopped,
+// partially downloaded originals are kept with their ETags to resume downloads at the next start
+func (vc *VideoCase) cleanTemp() {
+	entries, err := os.ReadDir(vc.tmp)
+	if err != nil {
+		vc.l.Error("can't read temp dir", domain.Stage(domain.StageCleanup), domain.F("dir", vc.tmp), domain.Err(err))
+		return
+	}
+
+	names := make(map[string]bool, len(entries))
+	for _, e := range entries {
+		names[e.Name()] = true
+	}
+
+	var removed, kept int
+
+	for _, e := range entries {
+		name := e.Name()
+
+		if !e.IsDir() && (names[domain.DownloadMetaPath(name)] || names[originalOf(name)]) {
+			kept++
+			continue
+		}
+
+		if err := os.RemoveAll(filepath.Join(vc.tmp, name)); err != nil {
+			vc.l.Error("can't remove temp file", domain.Stage(domain.StageCleanup), domain.F("file", name), domain.Err(err))
+			continue
+		}
+
+		removed++
+	}
+
+	vc.l.Info("temp dir is cleaned", domain.Stage(domain.StageCleanup), domain.F("removed", removed), domain.F("kept", kept))
+}
+
+// originalOf returns a name of a partially downloaded original by a name of its ETag file,
+// it's empty if name isn't an ETag file
+func originalOf(name string) string {
+	orig := strings.TrimSuffix(name, filepath.Ext(name))
+	if orig != name && domain.DownloadMetaPath(orig) == name {
+		return orig
+	}
+
+	return ""
+}
@@ -3,217 +3,650 @@ package interactor
 import (
 	"context"
 	"fmt"
+	"github.com/pkg/errors"
 	"net/url"
 	"os"
 	"path"
+	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
-	"videoconverter/bootstrap"
+	"time"
 	"videoconverter/domain"
 )
 
+var (
+	errNotFull  = errors.New("не все форматы были обработаны")
+	errNoLadder = errors.New("нет форматов основной лесенки для упаковки")
+
+	errFull       = errors.New("видео имеет все форматы")
+	errHasFormats = errors.New("видео имеет один или несколько форматов")
+)
+
+// task describe a video queued for processing,
+// rr and p are formats which should be made
+type task struct {
+	ctx context.Context
+	v   *domain.Video
+	rr  []domain.Rendition
+	p   domain.Packaging
+}
+
 // VideoCase describe a video interactor
 // used for start vide use cases
 type VideoCase struct {
 	env         string
 	tmp         string
 	rmOrig      bool
+	rmReplaced  bool
 	skipNotFull bool
-	ch          map[int]chan int
+	fatal       chan<- struct{}
 	db          domain.Storager
+	jobs        domain.JobStore
 	cloud       domain.Clouder
 	encoder     domain.Encoder
-
-	l *bootstrap.Logger
+	metrics     domain.Metrics
+	renditions  []domain.Rendition
+	packaging   domain.Packaging
+	singlePass  bool
+	limits      domain.Limits
+	timeouts    domain.EncodeTimeouts
+	downloads   semaphore
+	encodes     semaphore
+	uploads     semaphore
+
+	// intake is done when new videos mustn't be started, work is done when running ones are interrupted
+	intake context.Context
+	work   context.Context
+
+	// mu guards fields of the server mode
+	mu     sync.Mutex
+	queue  chan task
+	active map[int64]*activeVideo
+
+	l domain.Logger
 }
 
-// NewVideoCase returns a ready for use instance of VideoCase
-func NewVideoCase(ch map[int]chan int, env string, tmp string, isRmOrig bool, isSkipNotFull bool, db domain.Storager, cloud domain.Clouder, encoder domain.Encoder, l *bootstrap.Logger) *VideoCase {
+// NewVideoCase returns a ready for use instance of VideoCase,
+// fatal receives a request to stop the program on a database error
+func NewVideoCase(fatal chan<- struct{}, env string, tmp string, isRmOrig bool, isRmReplaced bool, isSkipNotFull bool, rr []domain.Rendition, p domain.Packaging, isSinglePass bool, limits domain.Limits, timeouts domain.EncodeTimeouts, db domain.Storager, jobs domain.JobStore, cloud domain.Clouder, encoder domain.Encoder, metrics domain.Metrics, l domain.Logger) *VideoCase {
 	return &VideoCase{
 		env:         env,
-		ch:          ch,
+		fatal:       fatal,
 		rmOrig:      isRmOrig,
+		rmReplaced:  isRmReplaced,
 		skipNotFull: isSkipNotFull,
 		tmp:         tmp,
 		db:          db,
+		jobs:        jobs,
 		cloud:       cloud,
 		encoder:     encoder,
+		metrics:     metrics,
+		renditions:  rr,
+		packaging:   p,
+		singlePass:  isSinglePass,
+		limits:      limits,
+		timeouts:    timeouts,
+		downloads:   newSemaphore(limits.Downloads),
+		encodes:     newSemaphore(limits.Encodes),
+		uploads:     newSemaphore(limits.Uploads),
+		active:      make(map[int64]*activeVideo),
 		l:           l,
 	}
 }
 
-// Start starts the processing all videos case
-func (vc *VideoCase) Start(ctx context.Context) {
-	videos, err := vc.db.Videos()
+// Start processes videos selected by f, new videos aren't started when ctx is done
+// and running ones are interrupted when work is done. It returns when all workers are stopped.
+// SKIP_NOT_FULL isn't applied to videos requested by ids, formats of force are made again.
+func (vc *VideoCase) Start(ctx, work context.Context, f domain.VideoFilter, force domain.Force) {
+	vc.intake, vc.work = ctx, work
+
+	videos, err := vc.videos(f)
 	if err != nil {
-		vc.l.E("Get videos:", err.Error())
-		vc.ch[domain.ChDone] <- 1
+		vc.l.Error("can't get videos", domain.Err(err))
+		vc.abort()
 		return
 	}
 
-	vc.ch[domain.ChAll] <- len(videos)
+	vc.metrics.VideosFound(len(videos))
+
+	resume := vc.resumeFirst(videos)
+
+	var tasks []task
+
+	for i := range videos {
+		v := &videos[i]
+
+		rr, p, _, err := vc.formats(v, resume[v.ID] || f.IsRequested(v.ID), force)
+		if err != nil {
+			if resume[v.ID] {
+				vc.closeJobs(v.ID, err)
+			}
+
+			continue
+		}
+
+		tasks = append(tasks, task{work, v, rr, p})
+	}
+
+	vc.metrics.Queued(len(tasks))
+
+	queue := make(chan task)
 
 	var wg sync.WaitGroup
 
+	for i := 0; i < vc.limits.Videos; i++ {
+		wg.Add(1)
+		go vc.worker(&wg, queue)
+	}
+
 loop:
-	for _, video := range videos {
+	for i, t := range tasks {
 		select {
 		case <-ctx.Done():
-			vc.l.D(fmt.Sprintln("Time is over."))
+			vc.l.Info("stopped taking new videos", domain.F("left", len(tasks)-i))
+			vc.metrics.Queued(i - len(tasks))
 			break loop
 		default:
+		}
 
-			v := video
+		vc.setState(t.v.ID, "", domain.JobQueued, nil)
 
-			if v.IsFull() {
-				vc.l.D(fmt.Sprintf("Видео %d имеет все форматы, пропускаю", v.ID))
-				continue loop
-			}
+		select {
+		case <-ctx.Done():
+			vc.l.Info("stopped taking new videos", domain.F("left", len(tasks)-i))
+			vc.metrics.Queued(i - len(tasks))
+			break loop
+		case queue <- t:
+		}
+	}
 
-			if vc.skipNotFull && v.IsHasAnyFormat() {
-				vc.l.D(fmt.Sprintf("Проверьте видео %d, оно имеет один или несколько форматов, пропускаю", v.ID))
-				continue loop
-			}
+	close(queue)
+	wg.Wait()
 
-			if v.LinkOrig.String == "" {
-				vc.l.D(fmt.Sprintf("Видео %d имеет пустую ссылку на оригинал, пропускаю", v.ID))
-				continue loop
-			}
+	vc.cleanTemp()
+}
 
-			escapedURL, err := url.PathUnescape(v.LinkOrig.String)
-			if err != nil {
-				vc.l.E(fmt.Sprintf("Не удалось экранировать URL %s\nПропускаю обработку", v.LinkOrig.String))
+// videos returns videos selected by f, requested ids which aren't found are logged
+func (vc *VideoCase) videos(f domain.VideoFilter) ([]domain.Video, error) {
+	if f.IsEmpty() {
+		return vc.db.Videos()
+	}
 
-				continue loop
-			}
+	videos, err := vc.db.FilterVideos(f)
+	if err != nil {
+		return nil, err
+	}
 
-			cURL, err := url.Parse(v.LinkOrig.String)
-			if err != nil {
-				vc.l.E(fmt.Sprintf("Ссылка на оригинал не является валидным URL : %s", v.LinkOrig.String))
-				continue loop
-			}
+	found := make(map[int64]bool, len(videos))
+	for _, v := range videos {
+		found[v.ID] = true
+	}
 
-			cloudDir, cloudFile := path.Split(cURL.Path)
-			v.CloudDir = strings.ReplaceAll(cloudDir, "/synergy/", "")
-			v.FilenameOrig = domain.FormatFileName(cloudFile)
+	for _, id := range f.IDs {
+		if !found[id] {
+			vc.l.Warn("requested video isn't found", domain.VideoID(id))
+		}
+	}
 
-			f, err := os.Create(vc.tmp + "/" + v.FilenameOrig)
-			if err != nil {
-				vc.l.E(fmt.Sprintf("Create a temp file: %v", err))
-				continue loop
-			}
+	vc.l.Info("videos are selected by the filter", domain.F("count", len(videos)))
 
-			vc.l.D(fmt.Sprintf("Загружаю оригинал видео ID %d по ссылке %s", v.ID, v.LinkOrig.String))
+	return videos, nil
+}
 
-			err = vc.cloud.DownloadFile(v.LinkOrig.String, f)
-			if err != nil {
-				vc.l.E(fmt.Sprintf(" Ошибка загрузки ориганала ID %d по ссылке %s: %v", v.ID, v.LinkOrig.String, err))
-				f.Close()
+// abort requests to stop the program because of a database error
+func (vc *VideoCase) abort() {
+	select {
+	case vc.fatal <- struct{}{}:
+	default:
+	}
+}
 
-				continue loop
-			}
+// resumeFirst sorts videos so interrupted ones go first, they are processed even if they already have some formats.
+// It returns ids of interrupted videos.
+func (vc *VideoCase) resumeFirst(videos []domain.Video) map[int64]bool {
+	resume := vc.resumable()
+	sort.SliceStable(videos, func(i, j int) bool {
+		return resume[videos[i].ID] && !resume[videos[j].ID]
+	})
 
-			f.Close()
+	return resume
+}
 
-			v.LocalPathOrig = f.Name()
+// worker downloads originals of videos from queue and processes them one by one
+func (vc *VideoCase) worker(wg *sync.WaitGroup, queue <-chan task) {
+	defer wg.Done()
 
-			v.LinkOrig.String = escapedURL
+	for t := range queue {
+		vc.run(t)
+	}
+}
 
-			wg.Add(1)
-			go vc.ProcessingVideo(&wg, &v, cloudFile)
+// run downloads an original of the video of task t and makes its formats
+func (vc *VideoCase) run(t task) {
+	t.ctx = domain.WithLogger(t.ctx, vc.l.With(domain.VideoID(t.v.ID)))
+
+	vc.metrics.Queued(-1)
+	vc.metrics.Processing(1)
+
+	defer vc.metrics.Processing(-1)
+	defer vc.finish(t.v.ID)
+
+	// a video which isn't started before a shutdown stays queued and is resumed at the next start
+	if vc.intake.Err() != nil {
+		vc.log(t.ctx).Info("video is left in the queue")
+		return
+	}
+
+	if err := t.ctx.Err(); err != nil {
+		vc.setState(t.v.ID, "", domain.JobFailed, err)
+		return
+	}
+
+	if err := vc.download(t.ctx, t.v); err != nil {
+		vc.log(t.ctx).Error("original download failed", domain.Stage(domain.StageDownload), domain.F("url", t.v.LinkOrig.String), domain.Err(err))
+		vc.setState(t.v.ID, "", domain.JobFailed, err)
+
+		return
+	}
+
+	vc.ProcessingVideo(t.ctx, t.v, t.rr, t.p)
+}
+
+// prepare checks that video v needs processing and fills its cloud and local file names,
+// isResumed allows to process an interrupted video which has some formats
+func (vc *VideoCase) prepare(v *domain.Video, isResumed bool) error {
+	switch err := vc.skip(v, isResumed); err {
+	case errFull:
+		vc.l.Debug("video has all formats, skipping", domain.VideoID(v.ID))
+		return err
+	case errHasFormats:
+		vc.l.Info("video has some formats, skipping", domain.VideoID(v.ID))
+		return err
+	}
+
+	return vc.locate(v)
+}
+
+// skip returns errFull or errHasFormats if missing formats of video v aren't made,
+// isResumed allows to process an interrupted video which has some formats
+func (vc *VideoCase) skip(v *domain.Video, isResumed bool) error {
+	if v.IsFull(vc.codes()) {
+		return errFull
+	}
+
+	if vc.skipNotFull && v.IsHasAnyFormat(vc.codes()) && !isResumed {
+		return errHasFormats
+	}
+
+	return nil
+}
+
+// locate fills cloud and local file names of the original of video v
+func (vc *VideoCase) locate(v *domain.Video) error {
+	if v.LinkOrig.String == "" {
+		vc.l.Debug("video has an empty original link, skipping", domain.VideoID(v.ID))
+		return errors.WithStack(ErrEmptyOriginal)
+	}
+
+	// formats of an original outside of the cloud are uploaded by the path of its link
+	cloudPath, err := vc.cloud.Path(v.LinkOrig.String)
+	if err != nil {
+		u, uErr := url.Parse(v.LinkOrig.String)
+		if uErr != nil || u.Host == "" {
+			vc.l.Error("original link isn't a valid URL", domain.VideoID(v.ID), domain.F("url", v.LinkOrig.String), domain.Err(err))
+			return err
 		}
+
+		vc.l.Debug("original is outside of the cloud", domain.VideoID(v.ID), domain.F("url", v.LinkOrig.String))
+
+		cloudPath = strings.TrimPrefix(u.Path, "/")
+		v.ForeignOrig = true
 	}
 
-	wg.Wait()
+	cloudDir, cloudFile := path.Split(cloudPath)
+	v.CloudDir = cloudDir
+	v.CloudFileOrig = cloudFile
+	v.FilenameOrig = domain.FormatFileName(cloudFile)
 
-	vc.ch[domain.ChDone] <- 1
+	return nil
 }
 
-// ProcessingVideo start the processing of one video,
+// download downloads an original of video v into the temp dir
+func (vc *VideoCase) download(ctx context.Context, v *domain.Video) error {
+	escapedURL, err := url.PathUnescape(v.LinkOrig.String)
+	if err != nil {
+		return errors.Wrapf(err, "не удалось экранировать URL %s", v.LinkOrig.String)
+	}
+
+	vc.downloads.acquire()
+	defer vc.downloads.release()
+
+	// an existing file is kept to resume its download
+	f, err := os.OpenFile(vc.tmp+"/"+v.FilenameOrig, os.O_CREATE|os.O_RDWR, os.FileMode(0660))
+	if err != nil {
+		return errors.Wrap(err, "create a temp file")
+	}
+	defer f.Close()
+
+	vc.log(ctx).Info("downloading original", domain.Stage(domain.StageDownload), domain.F("url", v.LinkOrig.String))
+	vc.setState(v.ID, "", domain.JobDownloading, nil)
+
+	before := fileSize(f)
+	err = vc.cloud.DownloadFile(ctx, v.LinkOrig.String, f)
+
+	// the file is downloaded again from the beginning if it can't be resumed
+	transferred := fileSize(f) - before
+	if transferred < 0 {
+		transferred = fileSize(f)
+	}
+
+	vc.metrics.Downloaded(transferred, err)
+
+	if err != nil {
+		return err
+	}
+
+	v.LocalPathOrig = f.Name()
+	v.LinkOrig.String = escapedURL
+
+	return nil
+}
+
+// ProcessingVideo start the processing of one video into renditions rr and packaging formats p,
 // delete original after processing
-func (vc *VideoCase) ProcessingVideo(g *sync.WaitGroup, v *domain.Video, cloudFile string) {
-	vc.l.D(fmt.Sprintf("Начинаю обработку видео с ID %d", v.ID))
+func (vc *VideoCase) ProcessingVideo(ctx context.Context, v *domain.Video, rr []domain.Rendition, p domain.Packaging) {
+	l := vc.log(ctx)
+	l.Info("processing started")
+	vc.setState(v.ID, "", domain.JobEncoding, nil)
+
+	// links are compared after processing to find replaced files
+	before := v.Links()
+
+	// files are encoded renditions which are kept to be packaged
+	var mu sync.Mutex
+	files := make(map[string]string)
 
 	defer func() {
+		for _, f := range files {
+			vc.remove(ctx, f)
+		}
+
 		err := os.Remove(v.LocalPathOrig)
 		if err != nil {
-			fmt.Sprintf("Remove file %s: %v", v.LocalPathOrig, err)
+			l.Error("can't remove original", domain.Stage(domain.StageCleanup), domain.F("file", v.LocalPathOrig), domain.Err(err))
+		}
+
+		err = os.Remove(domain.DownloadMetaPath(v.LocalPathOrig))
+		if err != nil && !os.IsNotExist(err) {
+			l.Error("can't remove download meta", domain.Stage(domain.StageCleanup), domain.F("file", domain.DownloadMetaPath(v.LocalPathOrig)), domain.Err(err))
 		}
 
-		g.Done()
+		if v.IsFull(vc.codes()) {
+			vc.setState(v.ID, "", domain.JobDone, nil)
+		} else {
+			vc.setState(v.ID, "", domain.JobFailed, errNotFull)
+		}
 	}()
 
-	var wg sync.WaitGroup
+	info, err := vc.encoder.Probe(ctx, v.LocalPathOrig)
+	if err != nil {
+		l.Warn("can't probe original, renditions aren't filtered", domain.Stage(domain.StageProbe), domain.Err(err))
+	} else {
+		v.Media = info
+		l.Info("original probed", domain.Stage(domain.StageProbe), domain.F("media", info.String()))
+	}
 
-	switch {
-	case v.Link1080.String == "":
-		wg.Add(1)
-		vc.p1080(&wg, v)
-		fallthrough
+	var skipped, fitted []domain.Rendition
 
-	case v.Link720.String == "":
-		wg.Add(1)
-		vc.p720(&wg, v)
-		fallthrough
+	for _, r := range rr {
+		if !vc.fits(v, r) {
+			l.Debug("video is smaller than rendition, skipping", domain.Quality(r.Name))
+			skipped = append(skipped, r)
 
-	case v.Link480.String == "":
-		wg.Add(1)
-		vc.p480(&wg, v)
-		fallthrough
+			continue
+		}
 
-	case v.Link360.String == "":
-		wg.Add(1)
-		vc.p360(&wg, v)
-		fallthrough
+		fitted = append(fitted, vc.scale(v, r))
+	}
 
-	case v.LinkPreview.String == "":
-		wg.Add(1)
-		vc.pPreview(&wg, v)
+	keep := make(map[string]bool)
+	if p.IsEnabled() {
+		for _, r := range vc.packaged(v) {
+			keep[r.Name] = true
+		}
 	}
 
-	wg.Wait()
+	if vc.singlePass && len(fitted) > 1 {
+		files = vc.processAll(ctx, v, fitted, keep)
+	} else {
+		var wg sync.WaitGroup
+
+		for _, r := range fitted {
+			wg.Add(1)
+
+			go func(r domain.Rendition) {
+				defer wg.Done()
+
+				if f := vc.processRendition(ctx, v, r, keep[r.Name]); f != "" {
+					mu.Lock()
+					files[r.Name] = f
+					mu.Unlock()
+				}
+			}(r)
+		}
+
+		wg.Wait()
+	}
+
+	vc.fillSkipped(ctx, v, skipped)
+
+	if p.IsEnabled() {
+		vc.processPackage(ctx, v, p, files)
+	}
+
+	if vc.rmReplaced {
+		vc.removeReplaced(ctx, v, before)
+	}
+
+	if v.IsFull(vc.codes()) && vc.rmOrig {
+		if v.ForeignOrig {
+			l.Info("video is fully processed, original outside of the cloud is kept", domain.Stage(domain.StageCleanup))
+			return
+		}
 
-	if v.IsFull() && vc.rmOrig {
-		vc.l.D(fmt.Sprintf("Видео %s полностью обработано, удаляю оригинал", v.FilenameOrig))
+		l.Info("video is fully processed, removing original", domain.Stage(domain.StageCleanup))
 
-		if err := vc.cloud.Delete(v.CloudDir + cloudFile); err != nil {
-			vc.l.E(fmt.Sprintf("Ошибка удаления оригинала из облака %s\n%v", cloudFile, err))
+		if err := vc.cloud.Delete(ctx, v.CloudDir+v.CloudFileOrig); err != nil {
+			l.Error("can't remove original from cloud", domain.Stage(domain.StageCleanup), domain.F("file", v.CloudFileOrig), domain.Err(err))
 
 			return
 		}
 
-		if err := vc.db.UpdatePropertyByID(v.IDOrig.Int64, ""); err != nil {
-			vc.l.E(fmt.Sprintf("Ошибка очистки ссылки на оригинал в БД %s\n%v", cloudFile, err))
+		if err := vc.db.ClearOriginal(v); err != nil {
+			l.Error("can't clear original link", domain.Stage(domain.StageSave), domain.Err(err))
+		}
+	}
+}
+
+// missingPackaging returns packaging formats which video v hasn't yet
+func (vc *VideoCase) missingPackaging(v *domain.Video) domain.Packaging {
+	p := vc.packaging
+	p.HLS = p.HLS && v.Link(p.HLSProperty) == ""
+	p.DASH = p.DASH && v.Link(p.DASHProperty) == ""
+
+	return p
+}
+
+// fits checks that rendition r isn't taller than the original of video v, so the original isn't upscaled.
+// The smallest rendition of a variant fits an original which is smaller than all its renditions,
+// it's encoded at the height of the original then.
+func (vc *VideoCase) fits(v *domain.Video, r domain.Rendition) bool {
+	if r.Preview || v.Media == nil || r.Height <= v.Media.DisplayHeight() {
+		return true
+	}
+
+	smallest := vc.smallest(r.Variant)
+
+	return smallest.Name == r.Name && smallest.Height > v.Media.DisplayHeight()
+}
+
+// smallest returns the shortest rendition of variant
+func (vc *VideoCase) smallest(variant string) domain.Rendition {
+	var smallest domain.Rendition
+
+	for _, r := range vc.renditions {
+		if r.Preview || r.Variant != variant {
+			continue
+		}
+
+		if smallest.Name == "" || r.Height < smallest.Height {
+			smallest = r
+		}
+	}
+
+	return smallest
+}
+
+// scale lowers the height of rendition r to the height of the original of video v if r is taller
+func (vc *VideoCase) scale(v *domain.Video, r domain.Rendition) domain.Rendition {
+	if r.Preview || v.Media == nil || r.Height <= v.Media.DisplayHeight() {
+		return r
+	}
+
+	// an odd height can't be encoded in yuv420p
+	r.Height = v.Media.DisplayHeight() &^ 1
+
+	return r
+}
+
+// fillSkipped sets links of renditions rr which are taller than the original to the link of the tallest rendition
+// of the same variant made from it, so players get the best available quality
+func (vc *VideoCase) fillSkipped(ctx context.Context, v *domain.Video, rr []domain.Rendition) {
+	for _, r := range rr {
+		l := vc.log(ctx).With(domain.Quality(r.Name))
+
+		best := vc.best(v, r.Variant)
+		if best == nil {
+			if r.Variant != "" {
+				l.Info("variant has no smaller rendition, link is left empty", domain.F("variant", r.Variant))
+			}
+
+			continue
+		}
+
+		l.Info("using link of a smaller video", domain.F("source", best.Name))
+
+		if err := vc.saveLink(domain.WithLogger(ctx, l), v, r.Property, v.Link(best.Property)); err != nil {
+			l.Error("can't save link", domain.Stage(domain.StageSave), domain.Err(err))
+			vc.setState(v.ID, r.Name, domain.JobFailed, err)
+
+			if isFatal(err) {
+				vc.abort()
+				return
+			}
+
+			continue
 		}
+
+		vc.setState(v.ID, r.Name, domain.JobDone, nil)
 	}
 }
 
-// process converts a video to required format and uploads to the cloud
-func (vc *VideoCase) process(v *domain.Video, q domain.VQ) (string, error) {
+// best returns the tallest rendition of variant which video v has and which isn't taller than its original,
+// nil if there is no one
+func (vc *VideoCase) best(v *domain.Video, variant string) *domain.Rendition {
+	var best *domain.Rendition
+
+	for i, r := range vc.renditions {
+		if r.Preview || r.Variant != variant || !vc.fits(v, r) || v.Link(r.Property) == "" {
+			continue
+		}
+
+		if best == nil || r.Height > best.Height {
+			best = &vc.renditions[i]
+		}
+	}
+
+	return best
+}
+
+// log returns the logger of ctx which has fields of the processed video
+func (vc *VideoCase) log(ctx context.Context) domain.Logger {
+	return domain.LoggerFrom(ctx, vc.l)
+}
+
+// codes returns property codes of all formats which a full processed video has
+func (vc *VideoCase) codes() []string {
+	return append(domain.PropertyCodes(vc.renditions), vc.packaging.Codes()...)
+}
+
+// process converts a video to rendition r and uploads to the cloud, returns a link and the converted file
+// which is left on the disk, the file is empty if encoding failed
+func (vc *VideoCase) process(ctx context.Context, v *domain.Video, r domain.Rendition) (string, string, error) {
+	vc.setState(v.ID, r.Name, domain.JobEncoding, nil)
+
+	newV, err := vc.encode(ctx, v, r, r.Name)
+	if err != nil {
+		return "", "", err
+	}
+
+	vc.setState(v.ID, r.Name, domain.JobUploading, nil)
+
+	u, err := vc.upload(ctx, v, newV)
+
+	return u, newV, err
+}
+
+// encode converts a video to rendition r when an encode slot is free,
+// progress of ffmpeg is reported to jobs
+func (vc *VideoCase) encode(ctx context.Context, v *domain.Video, r domain.Rendition, jobs ...string) (string, error) {
 	var newV string
 	var err error
 
-	if q == domain.QPreview {
-		newV, err = vc.encoder.CreatePreview(vc.tmp, v.LocalPathOrig)
+	vc.encodes.acquire()
+	defer vc.encodes.release()
+
+	start := time.Now()
+	encodeCtx, finish := vc.watch(ctx, v, 1, jobs...)
+
+	if r.Preview {
+		newV, err = vc.encoder.CreatePreview(encodeCtx, vc.tmp, v.LocalPathOrig)
 	} else {
-		newV, err = vc.encoder.Convert(vc.tmp, v.LocalPathOrig, q)
+		newV, err = vc.encoder.Convert(encodeCtx, vc.tmp, v.LocalPathOrig, r)
 	}
 
-	if err != nil {
-		vc.ch[domain.ChNotConverted] <- 1
+	err = finish(err)
+	vc.metrics.Encoded(r.Name, time.Since(start), err)
 
-		return "", err
+	return newV, err
+}
+
+// remove removes a local file of a made format
+func (vc *VideoCase) remove(ctx context.Context, file string) {
+	l := vc.log(ctx)
+	l.Debug("removing file", domain.Stage(domain.StageCleanup), domain.F("file", file))
+
+	if err := os.Remove(file); err != nil {
+		l.Error("can't remove file", domain.Stage(domain.StageCleanup), domain.F("file", file), domain.Err(err))
 	}
+}
 
-	defer func() {
-		vc.l.D(fmt.Sprintf("Remove file: %s", newV))
+// uploadFile uploads file f to the cloud path when an upload slot is free
+func (vc *VideoCase) uploadFile(ctx context.Context, cloudPath string, f *os.File) (string, error) {
+	vc.uploads.acquire()
+	defer vc.uploads.release()
 
-		if err := os.Remove(newV); err != nil {
-			vc.l.E(fmt.Sprintf("Error remove file: %s", newV))
-		}
-	}()
+	start := time.Now()
+	u, err := vc.cloud.UploadFile(ctx, cloudPath, f)
+	vc.metrics.Uploaded(fileSize(f), time.Since(start), err)
 
-	vc.ch[domain.ChConverted] <- 1
+	return u, err
+}
+
+// upload uploads a converted file newV to the cloud dir of video v
+func (vc *VideoCase) upload(ctx context.Context, v *domain.Video, newV string) (string, error) {
+	l := vc.log(ctx)
 
 	f, err := os.Open(newV)
 	if err != nil {
@@ -222,18 +655,16 @@ func (vc *VideoCase) process(v *domain.Video, q domain.VQ) (string, error) {
 	defer f.Close()
 
 	_, vName := path.Split(f.Name())
-	cloudPath := fmt.Sprintf("%s%s", v.CloudDir, vName)
+	cloudPath := fmt.Sprintf("%s%s", v.CloudDir, domain.Versioned(vName, v.Version))
 
-	vc.l.D(fmt.Sprintf("Загружаю на облако файл %s", f.Name()))
-	u, err := vc.cloud.UploadFile(cloudPath, f)
+	start := time.Now()
+	l.Debug("upload started", domain.Stage(domain.StageUpload), domain.F("file", f.Name()))
+	u, err := vc.uploadFile(ctx, cloudPath, f)
 	if err != nil {
-		vc.ch[domain.ChNotUploaded] <- 1
 		return "", err
 	}
 
-	vc.l.D(fmt.Sprintf("Успешно загрузили файл %s", f.Name()))
-
-	vc.ch[domain.ChUploaded] <- 1
+	l.Info("upload finished", domain.Stage(domain.StageUpload), domain.F("file", f.Name()), domain.DurationMs(time.Since(start)))
 
 	eu, err := url.Parse(u)
 	if err != nil {
@@ -243,187 +674,309 @@ func (vc *VideoCase) process(v *domain.Video, q domain.VQ) (string, error) {
 	return eu.String(), nil
 }
 
-// p1080 start process method and update video data in the database
-func (vc *VideoCase) p1080(wg *sync.WaitGroup, v *domain.Video) {
-	defer wg.Done()
-
-	u, err := vc.process(v, domain.Q1080)
-	if err != nil {
-		vc.l.E(fmt.Sprintf("Ошибка обработки видео %d: %v", v.ID, err))
-		return
+// processAll converts a video to all renditions rr in one encoder run,
+// uploads them to the cloud and updates video data in the database.
+// It returns files of renditions which are kept on the disk, a file is kept if keep has its rendition.
+func (vc *VideoCase) processAll(ctx context.Context, v *domain.Video, rr []domain.Rendition, keep map[string]bool) map[string]string {
+	for _, r := range rr {
+		vc.setState(v.ID, r.Name, domain.JobEncoding, nil)
 	}
 
-	vc.l.D("Ссылка на облако", u)
+	vc.encodes.acquire()
+	start := time.Now()
+	encodeCtx, finish := vc.watch(ctx, v, len(rr), domain.RenditionNames(rr)...)
+	files, err := vc.encoder.ConvertAll(encodeCtx, vc.tmp, v.LocalPathOrig, rr)
+	err = finish(err)
+	vc.encodes.release()
 
-	qp, err := vc.db.QualityIDs()
-	if err != nil {
-		vc.l.E(fmt.Sprintf("Ошибка получения ID форматов из БД: %v", err))
-		vc.ch[domain.ChDone] <- 1
-		return
+	// every rendition took the whole run of the single ffmpeg process
+	for _, r := range rr {
+		vc.metrics.Encoded(r.Name, time.Since(start), err)
 	}
 
-	v.Link1080.String = u
+	if err != nil {
+		vc.log(ctx).Error("single pass encoding failed", domain.Stage(domain.StageEncode), domain.Err(err))
 
-	if v.ID1080.Valid {
-		if err := vc.db.UpdatePropertyByID(v.ID1080.Int64, u); err != nil {
-			vc.l.E(fmt.Sprintf("Ошибка обновления поля %d для видео %d в БД: %v", v.ID1080.Int64, v.ID, err))
-			vc.ch[domain.ChDone] <- 1
+		for _, r := range rr {
+			vc.setState(v.ID, r.Name, domain.JobFailed, err)
 		}
 
-		return
+		return nil
 	}
 
-	if err := vc.db.InsertProperty(v.ID, qp.ID1080, u); err != nil {
-		vc.l.E(fmt.Sprintf("Ошибка  добавления поля 1080 для видео %d в БД: %v", v.ID, err))
-		vc.ch[domain.ChDone] <- 1
+	for _, r := range rr {
+		l := vc.log(ctx).With(domain.Quality(r.Name))
+		vc.setState(v.ID, r.Name, domain.JobUploading, nil)
+
+		u, err := vc.upload(domain.WithLogger(ctx, l), v, files[r.Name])
+
+		if !keep[r.Name] {
+			vc.remove(domain.WithLogger(ctx, l), files[r.Name])
+			delete(files, r.Name)
+		}
+
+		if err != nil {
+			l.Error("upload failed", domain.Stage(domain.StageUpload), domain.Err(err))
+			vc.setState(v.ID, r.Name, domain.JobFailed, err)
+			continue
+		}
+
+		l.Debug("rendition uploaded", domain.F("url", u))
+
+		if err := vc.saveLink(domain.WithLogger(ctx, l), v, r.Property, u); err != nil {
+			l.Error("can't save link", domain.Stage(domain.StageSave), domain.Err(err))
+			vc.setState(v.ID, r.Name, domain.JobFailed, err)
+
+			if isFatal(err) {
+				vc.abort()
+				return files
+			}
+
+			continue
+		}
+
+		vc.setState(v.ID, r.Name, domain.JobDone, nil)
 	}
+
+	return files
 }
 
-// p480 start process method and update video data in the database
-func (vc *VideoCase) p480(wg *sync.WaitGroup, v *domain.Video) {
-	defer wg.Done()
+// processRendition start process method and update video data in the database,
+// it returns the converted file if keep is set, otherwise the file is removed
+func (vc *VideoCase) processRendition(ctx context.Context, v *domain.Video, r domain.Rendition, keep bool) string {
+	l := vc.log(ctx).With(domain.Quality(r.Name))
+	ctx = domain.WithLogger(ctx, l)
+
+	u, file, err := vc.process(ctx, v, r)
+	if file != "" && !keep {
+		vc.remove(ctx, file)
+		file = ""
+	}
 
-	u, err := vc.process(v, domain.Q480)
 	if err != nil {
-		vc.l.E(fmt.Sprintf("Ошибка обработки видео %d: %v", v.ID, err))
-		return
+		l.Error("rendition processing failed", domain.Err(err))
+		vc.setState(v.ID, r.Name, domain.JobFailed, err)
+		return file
 	}
 
-	vc.l.D("Ссылка на облако", u)
+	l.Debug("rendition uploaded", domain.F("url", u))
 
-	qp, err := vc.db.QualityIDs()
-	if err != nil {
-		vc.l.E(fmt.Sprintf("Ошибка получения ID форматов из БД: %v", err))
-		vc.ch[domain.ChDone] <- 1
-		return
+	if err := vc.saveLink(ctx, v, r.Property, u); err != nil {
+		l.Error("can't save link", domain.Stage(domain.StageSave), domain.Err(err))
+		vc.setState(v.ID, r.Name, domain.JobFailed, err)
+
+		if isFatal(err) {
+			vc.abort()
+		}
+
+		return file
 	}
 
-	v.Link480.String = u
-	if v.ID480.Valid {
-		if err := vc.db.UpdatePropertyByID(v.ID480.Int64, u); err != nil {
-			vc.l.E(fmt.Sprintf("Ошибка обновления поля %d для видео %d в БД: %v", v.ID480.Int64, v.ID, err))
-			vc.ch[domain.ChDone] <- 1
+	vc.setState(v.ID, r.Name, domain.JobDone, nil)
+
+	return file
+}
+
+// processPackage segments renditions of the main ladder of a video into adaptive streaming formats enabled in p,
+// uploads all files to the cloud and updates links to manifests in the database. Files are renditions encoded
+// in this run by their names, renditions made before are encoded again and added to files.
+func (vc *VideoCase) processPackage(ctx context.Context, v *domain.Video, p domain.Packaging, files map[string]string) {
+	l := vc.log(ctx)
+
+	rr := vc.packaged(v)
+	jobs := packageJobs(p)
+
+	if len(rr) == 0 {
+		l.Error("there are no renditions of the main ladder, packaging skipped")
+
+		for _, j := range jobs {
+			vc.setState(v.ID, j, domain.JobFailed, errNoLadder)
 		}
 
 		return
 	}
 
-	if err := vc.db.InsertProperty(v.ID, qp.ID480, u); err != nil {
-		vc.l.E(fmt.Sprintf("Ошибка добавления поля 480p видео %d в БД: %v", v.ID, err))
-		vc.ch[domain.ChDone] <- 1
+	for _, j := range jobs {
+		vc.setState(v.ID, j, domain.JobEncoding, nil)
 	}
-}
 
-// p720 start process method and update video data in the database
-func (vc *VideoCase) p720(wg *sync.WaitGroup, v *domain.Video) {
-	defer wg.Done()
+	start := time.Now()
+
+	pkg, err := vc.segment(ctx, v, rr, files, p, jobs)
+
+	for _, j := range jobs {
+		vc.metrics.Encoded(j, time.Since(start), err)
+	}
 
-	u, err := vc.process(v, domain.Q720)
 	if err != nil {
-		vc.l.E(fmt.Sprintf("Ошибка обработки видео %d: %v", v.ID, err))
+		l.Error("packaging failed", domain.Stage(domain.StagePackage), domain.Err(err))
+
+		for _, j := range jobs {
+			vc.setState(v.ID, j, domain.JobFailed, err)
+		}
+
 		return
 	}
 
-	vc.l.D("Ссылка на облако", u)
+	defer func() {
+		l.Debug("removing dir", domain.Stage(domain.StageCleanup), domain.F("dir", pkg.Dir))
 
-	qp, err := vc.db.QualityIDs()
-	if err != nil {
-		vc.l.E(fmt.Sprintf("Ошибка получения ID форматов из БД: %v", err))
-		vc.ch[domain.ChDone] <- 1
-		return
+		if err := os.RemoveAll(pkg.Dir); err != nil {
+			l.Error("can't remove dir", domain.Stage(domain.StageCleanup), domain.F("dir", pkg.Dir), domain.Err(err))
+		}
+	}()
+
+	for _, j := range jobs {
+		vc.setState(v.ID, j, domain.JobUploading, nil)
 	}
 
-	v.Link720.String = u
+	_, dirName := path.Split(pkg.Dir)
 
-	if v.ID720.Valid {
-		if err := vc.db.UpdatePropertyByID(v.ID720.Int64, u); err != nil {
-			vc.l.E(fmt.Sprintf("Ошибка обновления поля %d у видео %d в БД: %v", v.ID720.Int64, v.ID, err))
-			vc.ch[domain.ChDone] <- 1
+	links, err := vc.uploadDir(ctx, pkg.Dir, v.CloudDir+domain.Versioned(dirName, v.Version)+"/")
+	if err != nil {
+		l.Error("package upload failed", domain.Stage(domain.StageUpload), domain.Err(err))
 
+		for _, j := range jobs {
+			vc.setState(v.ID, j, domain.JobFailed, err)
 		}
 
 		return
 	}
 
-	if err := vc.db.InsertProperty(v.ID, qp.ID720, u); err != nil {
-		vc.l.E(fmt.Sprintf("Ошибка обновления поля %d в БД: %v", v.ID720.Int64, err))
-		vc.ch[domain.ChDone] <- 1
+	type manifest struct {
+		job, code, link string
 	}
-}
-
-// p360 start process method and update video data in the database
-func (vc *VideoCase) p360(wg *sync.WaitGroup,
-	v *domain.Video) {
-	defer wg.Done()
 
-	u, err := vc.process(v, domain.Q360)
-	if err != nil {
-		vc.l.E(fmt.Sprintf("Ошибка обработки видео %d: %v", v.ID, err))
-		return
+	var manifests []manifest
+	if p.HLS {
+		manifests = append(manifests, manifest{jobHLS, p.HLSProperty, links[pkg.HLSMaster]})
+	}
+	if p.DASH {
+		manifests = append(manifests, manifest{jobDASH, p.DASHProperty, links[pkg.DASHManifest]})
 	}
 
-	vc.l.D("Ссылка на облако", u)
+	for _, m := range manifests {
+		l.Debug("manifest uploaded", domain.Quality(m.job), domain.F("url", m.link))
 
-	qp, err := vc.db.QualityIDs()
-	if err != nil {
-		vc.l.E(fmt.Sprintf("Ошибка получения ID форматов из БД: %v", err))
-		vc.ch[domain.ChDone] <- 1
+		if err := vc.saveLink(domain.WithLogger(ctx, l.With(domain.Quality(m.job))), v, m.code, m.link); err != nil {
+			l.Error("can't save manifest link", domain.Quality(m.job), domain.Stage(domain.StageSave), domain.Err(err))
+			vc.setState(v.ID, m.job, domain.JobFailed, err)
 
-		return
-	}
+			if isFatal(err) {
+				vc.abort()
+				return
+			}
 
-	v.Link360.String = u
+			continue
+		}
 
-	if v.ID360.Valid {
-		if err = vc.db.UpdatePropertyByID(v.ID360.Int64, u); err != nil {
-			vc.l.E(fmt.Sprintf("Ошибка обновления поля %d в БД у видео %d: %v", v.ID360.Int64, v.ID, err))
-			vc.ch[domain.ChDone] <- 1
+		vc.setState(v.ID, m.job, domain.JobDone, nil)
+	}
+}
 
-			return
+// packaged returns renditions of the main ladder of video v which are segmented into packaging formats
+func (vc *VideoCase) packaged(v *domain.Video) []domain.Rendition {
+	var rr []domain.Rendition
+
+	for _, r := range vc.renditions {
+		if !r.Preview && r.Variant == "" && vc.fits(v, r) {
+			rr = append(rr, vc.scale(v, r))
 		}
 	}
 
-	if err = vc.db.InsertProperty(v.ID, qp.ID360, u); err != nil {
-		vc.l.E(fmt.Sprintf("Ошибка добавления поля для формата 360 у видео %d в БД: %v", v.ID, err))
-		vc.ch[domain.ChDone] <- 1
+	return rr
+}
 
-		return
+// segment encodes renditions rr of video v which files haven't, then copies streams of all of them into packaging formats p
+func (vc *VideoCase) segment(ctx context.Context, v *domain.Video, rr []domain.Rendition, files map[string]string, p domain.Packaging, jobs []string) (*domain.Package, error) {
+	for _, r := range rr {
+		if files[r.Name] != "" {
+			continue
+		}
+
+		vc.log(ctx).Debug("rendition is encoded again for packaging", domain.Quality(r.Name))
+
+		f, err := vc.encode(ctx, v, r, jobs...)
+		if err != nil {
+			return nil, err
+		}
+
+		files[r.Name] = f
 	}
+
+	vc.encodes.acquire()
+	defer vc.encodes.release()
+
+	encodeCtx, finish := vc.watch(ctx, v, 1, jobs...)
+	pkg, err := vc.encoder.Package(encodeCtx, vc.tmp, v.LocalPathOrig, rr, files, p, vc.hasAudio(ctx, v))
+
+	return pkg, finish(err)
 }
 
-// pPreview start process method and update video data in the database
-func (vc *VideoCase) pPreview(wg *sync.WaitGroup, v *domain.Video) {
-	defer wg.Done()
+// hasAudio checks that the original of video v has an audio stream, an original which wasn't probed
+// is probed again and is packaged without audio if it fails, because HLS streams can't map a missing stream
+func (vc *VideoCase) hasAudio(ctx context.Context, v *domain.Video) bool {
+	if v.Media != nil {
+		return len(v.Media.Audio) > 0
+	}
 
-	u, err := vc.process(v, domain.QPreview)
+	info, err := vc.encoder.Probe(ctx, v.LocalPathOrig)
 	if err != nil {
-		vc.l.E(fmt.Sprintf("Ошибка обработки видео %d: %v", v.ID, err))
-		return
+		vc.log(ctx).Warn("can't probe original, package has no audio", domain.Stage(domain.StageProbe), domain.Err(err))
+		return false
 	}
 
-	vc.l.D("Ссылка на облако", u)
+	return len(info.Audio) > 0
+}
 
-	qp, err := vc.db.QualityIDs()
-	if err != nil {
-		vc.l.E(fmt.Sprintf("Ошибка получения ID форматов из БД: %v", err))
-		vc.ch[domain.ChDone] <- 1
+// uploadDir uploads all files of the local directory dir into cloudDir keeping the directory tree,
+// returns links to uploaded files by their paths relative to dir
+func (vc *VideoCase) uploadDir(ctx context.Context, dir, cloudDir string) (map[string]string, error) {
+	links := make(map[string]string)
 
-		return
-	}
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
 
-	v.LinkPreview.String = u
+		rel = filepath.ToSlash(rel)
 
-	if v.IDPreview.Valid {
-		if err := vc.db.UpdatePropertyByID(v.IDPreview.Int64, u); err != nil {
-			vc.l.E(fmt.Sprintf("Ошибка обновления поля %d в БД: %v", v.IDPreview.Int64, err))
-			vc.ch[domain.ChDone] <- 1
+		f, err := os.Open(p)
+		if err != nil {
+			return err
 		}
+		defer f.Close()
 
-		return
+		vc.log(ctx).Debug("upload started", domain.Stage(domain.StageUpload), domain.F("file", p))
+
+		u, err := vc.uploadFile(ctx, cloudDir+rel, f)
+		if err != nil {
+			return err
+		}
+
+		links[rel] = u
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
 	}
 
-	if err := vc.db.InsertProperty(v.ID, qp.IDPreview, u); err != nil {
-		vc.l.E(fmt.Sprintf("Ошибка обновления поля %d в БД: %v", v.IDPreview.Int64, err))
-		vc.ch[domain.ChDone] <- 1
+	return links, nil
+}
+
+// fileSize returns a size of file f or 0 if it's unknown
+func fileSize(f *os.File) int64 {
+	info, err := f.Stat()
+	if err != nil {
+		return 0
 	}
+
+	return info.Size()
 }
@@ -0,0 +1,227 @@
+package interactor
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"videoconverter/domain"
+)
+
+func TestFits(t *testing.T) {
+	vc := newTestCase(t, testRenditions, domain.Packaging{})
+
+	tests := []struct {
+		name  string
+		media *domain.MediaInfo
+		want  map[string]bool
+	}{
+		{
+			name: "not probed",
+			want: map[string]bool{"720": true, "360": true, "720-hevc": true, "360-hevc": true, "preview": true},
+		},
+		{
+			name:  "taller renditions",
+			media: &domain.MediaInfo{Width: 854, Height: 480},
+			want:  map[string]bool{"720": false, "360": true, "720-hevc": false, "360-hevc": true, "preview": true},
+		},
+		{
+			name:  "smaller than all renditions",
+			media: &domain.MediaInfo{Width: 320, Height: 240},
+			want:  map[string]bool{"720": false, "360": true, "720-hevc": false, "360-hevc": true, "preview": true},
+		},
+		{
+			name:  "rotated",
+			media: &domain.MediaInfo{Width: 720, Height: 480, Rotation: 90},
+			want:  map[string]bool{"720": true, "360": true, "720-hevc": true, "360-hevc": true, "preview": true},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := newVideo(1, nil)
+			v.Media = tt.media
+
+			for _, r := range testRenditions {
+				if got := vc.fits(v, r); got != tt.want[r.Name] {
+					t.Errorf("fits(%s) = %v, want %v", r.Name, got, tt.want[r.Name])
+				}
+			}
+		})
+	}
+}
+
+func TestScale(t *testing.T) {
+	vc := newTestCase(t, testRenditions, domain.Packaging{})
+
+	tests := []struct {
+		name   string
+		media  *domain.MediaInfo
+		r      domain.Rendition
+		height int
+	}{
+		{name: "not probed", r: testRenditions[1], height: 360},
+		{name: "fits", media: &domain.MediaInfo{Height: 480}, r: testRenditions[1], height: 360},
+		{name: "taller", media: &domain.MediaInfo{Height: 240}, r: testRenditions[1], height: 240},
+		{name: "odd height", media: &domain.MediaInfo{Height: 241}, r: testRenditions[1], height: 240},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := newVideo(1, nil)
+			v.Media = tt.media
+
+			if got := vc.scale(v, tt.r); got.Height != tt.height {
+				t.Errorf("scale() height = %d, want %d", got.Height, tt.height)
+			}
+		})
+	}
+}
+
+func TestBest(t *testing.T) {
+	vc := newTestCase(t, testRenditions, domain.Packaging{})
+
+	v := newVideo(1, map[string]string{
+		"LINK_720":      cloudURL + "videos/720.mp4",
+		"LINK_360":      cloudURL + "videos/360.mp4",
+		"LINK_360_HEVC": cloudURL + "videos/360-hevc.mp4",
+	})
+	v.Media = &domain.MediaInfo{Height: 480}
+
+	tests := []struct {
+		variant string
+		want    string
+	}{
+		// 720 is linked by a previous run of a taller original, but doesn't fit this one
+		{variant: "", want: "360"},
+		{variant: "hevc", want: "360-hevc"},
+		{variant: "vp9", want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.variant, func(t *testing.T) {
+			var got string
+			if best := vc.best(v, tt.variant); best != nil {
+				got = best.Name
+			}
+
+			if got != tt.want {
+				t.Errorf("best() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFillSkipped(t *testing.T) {
+	vc := newTestCase(t, testRenditions, domain.Packaging{}, newVideo(1, nil))
+
+	v, _ := vc.db.Video(1)
+	v.Media = &domain.MediaInfo{Height: 480}
+
+	for _, code := range []string{"LINK_360", "LINK_360_HEVC"} {
+		if err := vc.db.SetLink(v, code, cloudURL+code); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	vc.fillSkipped(context.Background(), v, []domain.Rendition{testRenditions[0], testRenditions[2]})
+
+	want := map[string]string{"LINK_720": cloudURL + "LINK_360", "LINK_720_HEVC": cloudURL + "LINK_360_HEVC"}
+	for code, link := range want {
+		if got := vc.db.link(1, code); got != link {
+			t.Errorf("fillSkipped() %s = %q, want %q", code, got, link)
+		}
+	}
+
+	for _, name := range []string{"720", "720-hevc"} {
+		if got := vc.jobs.state(1, name); got != domain.JobDone {
+			t.Errorf("fillSkipped() job %s = %q, want %q", name, got, domain.JobDone)
+		}
+	}
+}
+
+func TestProcessingVideoSmallerThanLadder(t *testing.T) {
+	vc := newTestCase(t, testRenditions, domain.Packaging{}, newVideo(1, nil))
+	vc.encoder.media = &domain.MediaInfo{Width: 320, Height: 240}
+
+	v, _ := vc.db.Video(1)
+	if err := vc.locate(v); err != nil {
+		t.Fatal(err)
+	}
+
+	v.LocalPathOrig = filepath.Join(vc.tmp, v.FilenameOrig)
+	if err := os.WriteFile(v.LocalPathOrig, []byte("original"), 0664); err != nil {
+		t.Fatal(err)
+	}
+
+	vc.ProcessingVideo(context.Background(), v, testRenditions, domain.Packaging{})
+
+	heights := make(map[string]int)
+	for _, r := range vc.encoder.converted {
+		heights[r.Name] = r.Height
+	}
+
+	want := map[string]int{"360": 240, "360-hevc": 240}
+	if !reflect.DeepEqual(heights, want) {
+		t.Errorf("ProcessingVideo() encoded %v, want %v", heights, want)
+	}
+
+	if got := vc.jobs.state(1, ""); got != domain.JobDone {
+		t.Errorf("ProcessingVideo() video job = %q, want %q", got, domain.JobDone)
+	}
+
+	for _, r := range testRenditions {
+		if vc.db.link(1, r.Property) == "" {
+			t.Errorf("ProcessingVideo() left %s empty", r.Name)
+		}
+	}
+}
+
+func TestProcessingVideoPackagesEncodedFiles(t *testing.T) {
+	p := domain.Packaging{HLS: true, HLSProperty: "LINK_HLS", SegmentTime: 6}
+	// 360 was made by a previous run, so it's encoded again to be packaged
+	vc := newTestCase(t, testRenditions, p, newVideo(1, map[string]string{"LINK_360": cloudURL + "videos/360.mp4"}))
+	vc.encoder.media = &domain.MediaInfo{Width: 1280, Height: 720}
+
+	v, _ := vc.db.Video(1)
+	if err := vc.locate(v); err != nil {
+		t.Fatal(err)
+	}
+
+	v.LocalPathOrig = filepath.Join(vc.tmp, v.FilenameOrig)
+	if err := os.WriteFile(v.LocalPathOrig, []byte("original"), 0664); err != nil {
+		t.Fatal(err)
+	}
+
+	rr := v.Missing(testRenditions)
+	vc.ProcessingVideo(context.Background(), v, rr, vc.missingPackaging(v))
+
+	if len(vc.encoder.packaged) != 2 || vc.encoder.packaged["720"] == "" || vc.encoder.packaged["360"] == "" {
+		t.Errorf("ProcessingVideo() packaged %v, want files of 720 and 360", vc.encoder.packaged)
+	}
+
+	var encoded int
+	for _, r := range vc.encoder.converted {
+		if r.Name == "720" {
+			encoded++
+		}
+	}
+
+	if encoded != 1 {
+		t.Errorf("ProcessingVideo() encoded 720 %d times, want once", encoded)
+	}
+
+	if vc.db.link(1, "LINK_HLS") == "" {
+		t.Error("ProcessingVideo() didn't save the HLS link")
+	}
+
+	files, err := os.ReadDir(vc.tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, f := range files {
+		t.Errorf("ProcessingVideo() left %s in the temp dir", f.Name())
+	}
+}
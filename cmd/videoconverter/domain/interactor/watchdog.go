@@ -0,0 +1,116 @@
+package interactor
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"sync"
+	"time"
+	"videoconverter/domain"
+)
+
+// stallCheckInterval is an interval of checking that an ffmpeg process advances
+const stallCheckInterval = time.Second
+
+var (
+	errEncodeTimeout = errors.New("ffmpeg не завершился за отведенное время")
+	errEncodeStalled = errors.New("ffmpeg перестал продвигаться")
+)
+
+// watchdog kills an ffmpeg process which runs too long or doesn't advance
+type watchdog struct {
+	mu       sync.Mutex
+	last     domain.Progress
+	advanced time.Time
+	// reason is an error why the process was killed
+	reason error
+}
+
+// watch returns a copy of ctx for an ffmpeg process making n renditions for jobs of video v, the process reports progress
+// by withProgress and is killed if it runs longer than the encode timeout or doesn't advance for the stall timeout.
+// finish must be called with an error of the process when it ends, it returns a reason of the kill instead of err.
+func (vc *VideoCase) watch(ctx context.Context, v *domain.Video, n int, jobs ...string) (context.Context, func(err error) error) {
+	var d time.Duration
+	if v.Media != nil {
+		d = v.Media.Duration
+	}
+
+	timeout := vc.timeouts.Timeout(d, n)
+	l := vc.log(ctx)
+
+	ctx = vc.withProgress(ctx, v.ID, jobs...)
+	report := domain.ProgressFrom(ctx)
+
+	ctx, cancel := context.WithCancel(ctx)
+	w := &watchdog{advanced: time.Now()}
+
+	ctx = domain.WithProgress(ctx, func(p domain.Progress) {
+		w.mu.Lock()
+		if p.OutTime > w.last.OutTime || p.Frame > w.last.Frame {
+			w.last = p
+			w.advanced = time.Now()
+		}
+		w.mu.Unlock()
+
+		report(p)
+	})
+
+	kill := func(reason error) {
+		w.mu.Lock()
+		w.reason = reason
+		w.mu.Unlock()
+
+		l.Error("killing ffmpeg", domain.Stage(domain.StageEncode), domain.Err(reason), domain.F("timeout_ms", timeout.Milliseconds()))
+		cancel()
+	}
+
+	done := make(chan struct{})
+
+	go func() {
+		var deadline <-chan time.Time
+		if timeout > 0 {
+			t := time.NewTimer(timeout)
+			defer t.Stop()
+			deadline = t.C
+		}
+
+		var check <-chan time.Time
+		if vc.timeouts.Stall > 0 {
+			t := time.NewTicker(stallCheckInterval)
+			defer t.Stop()
+			check = t.C
+		}
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-deadline:
+				kill(errEncodeTimeout)
+				return
+			case <-check:
+				w.mu.Lock()
+				stalled := time.Since(w.advanced) > vc.timeouts.Stall
+				w.mu.Unlock()
+
+				if stalled {
+					kill(errEncodeStalled)
+					return
+				}
+			}
+		}
+	}()
+
+	return ctx, func(err error) error {
+		close(done)
+		cancel()
+
+		w.mu.Lock()
+		defer w.mu.Unlock()
+
+		if err != nil && w.reason != nil {
+			return errors.WithStack(w.reason)
+		}
+
+		return err
+	}
+}
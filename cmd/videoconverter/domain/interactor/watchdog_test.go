@@ -0,0 +1,89 @@
+package interactor
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"testing"
+	"time"
+	"videoconverter/domain"
+)
+
+func TestWatch(t *testing.T) {
+	errFailed := errors.New("ffmpeg failed")
+
+	tests := []struct {
+		name     string
+		timeouts domain.EncodeTimeouts
+		// advance reports a growing progress until the process ends
+		advance bool
+		wantErr error
+	}{
+		{
+			name:     "timeout",
+			timeouts: domain.EncodeTimeouts{Factor: 1, Min: 50 * time.Millisecond},
+			advance:  true,
+			wantErr:  errEncodeTimeout,
+		},
+		{
+			name:     "stall",
+			timeouts: domain.EncodeTimeouts{Stall: 10 * time.Millisecond},
+			wantErr:  errEncodeStalled,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vc := newTestCase(t, testRenditions, domain.Packaging{})
+			vc.timeouts = tt.timeouts
+
+			v := newVideo(1, nil)
+			v.Media = &domain.MediaInfo{Duration: 10 * time.Millisecond}
+
+			ctx, finish := vc.watch(context.Background(), v, 1, "720")
+			report := domain.ProgressFrom(ctx)
+
+			// the process runs until it's killed and fails then
+			for i := int64(1); ctx.Err() == nil; i++ {
+				if tt.advance {
+					report(domain.Progress{Frame: i})
+				}
+
+				select {
+				case <-ctx.Done():
+				case <-time.After(5 * time.Millisecond):
+				}
+			}
+
+			if err := finish(errFailed); errors.Cause(err) != tt.wantErr {
+				t.Errorf("finish() = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	t.Run("finished in time", func(t *testing.T) {
+		vc := newTestCase(t, testRenditions, domain.Packaging{})
+		vc.timeouts = domain.EncodeTimeouts{Factor: 10, Min: time.Minute, Stall: time.Minute}
+		vc.active[1] = &activeVideo{cancel: func() {}, progress: make(map[string]domain.Progress)}
+
+		v := newVideo(1, nil)
+		v.Media = &domain.MediaInfo{Duration: time.Second}
+
+		ctx, finish := vc.watch(context.Background(), v, 1, "720", "hls")
+		domain.ProgressFrom(ctx)(domain.Progress{Frame: 10, Percent: 50})
+
+		if err := finish(errFailed); err != errFailed {
+			t.Errorf("finish() = %v, want the error of the process %v", err, errFailed)
+		}
+
+		if ctx.Err() == nil {
+			t.Error("finish() didn't cancel the context of the process")
+		}
+
+		progress := vc.Progress(1)
+		for _, j := range []string{"720", "hls"} {
+			if progress[j].Frame != 10 {
+				t.Errorf("Progress() of %s = %+v, want the reported one", j, progress[j])
+			}
+		}
+	})
+}
@@ -1,26 +1,75 @@
 package domain
 
 import (
+	"context"
 	"os"
+	"time"
 )
 
 // Storager describe methods of storage Service
 type Storager interface {
 	Videos() ([]Video, error)
-	UpdatePropertyByID(id int64, value string) error
-	InsertProperty(elementID int64, propertyID int64, value string) error
-	QualityIDs() (*QualityProperty, error)
+	// FilterVideos returns videos selected by f
+	FilterVideos(f VideoFilter) ([]Video, error)
+	// Video returns a video by id or ErrNotFound
+	Video(id int64) (*Video, error)
+	SetLink(v *Video, code, link string) error
+	// ReplaceLink replaces link old of the property with code of video v by link in one update,
+	// it returns ErrLinkChanged if the property doesn't contain old anymore
+	ReplaceLink(v *Video, code, old, link string) error
+	ClearOriginal(v *Video) error
 }
 
-// Encoder describe methods of storage Encode
+// JobStore describe methods of a persistent store of processing states
+type JobStore interface {
+	SetState(videoID int64, rendition string, state JobState, msg string) error
+	Jobs(videoID int64) ([]Job, error)
+	All() ([]Job, error)
+	Unfinished() ([]Job, error)
+}
+
+// Encoder describe methods of storage Encode,
+// ffmpeg processes are killed when ctx is done and report progress to a callback set by WithProgress
 type Encoder interface {
-	Convert(tmp string, filePath string, quality VQ) (string, error)
-	CreatePreview(tmp, filePath string) (string, error)
+	Probe(ctx context.Context, filePath string) (*MediaInfo, error)
+	Convert(ctx context.Context, tmp string, filePath string, r Rendition) (string, error)
+	CreatePreview(ctx context.Context, tmp, filePath string) (string, error)
+	ConvertAll(ctx context.Context, tmp, filePath string, rr []Rendition) (map[string]string, error)
+	Package(ctx context.Context, tmp, filePath string, rr []Rendition, files map[string]string, p Packaging, audio bool) (*Package, error)
 }
 
 // Clouder describe methods of Cloud service
 type Clouder interface {
-	DownloadFile(u string, f *os.File) error
-	UploadFile(path string, f *os.File) (string, error)
-	Delete(filepath string) error
+	DownloadFile(ctx context.Context, u string, f *os.File) error
+	UploadFile(ctx context.Context, path string, f *os.File) (string, error)
+	Delete(ctx context.Context, filepath string) error
+	Path(u string) (string, error)
+}
+
+// Metrics describe methods of collecting processing metrics
+type Metrics interface {
+	// VideosFound counts videos got from the storage
+	VideosFound(n int)
+	// Queued changes a number of videos waiting for a worker by delta
+	Queued(delta int)
+	// Processing changes a number of videos processed right now by delta
+	Processing(delta int)
+	// Downloaded counts a download of an original, bytes is a size of transferred data
+	Downloaded(bytes int64, err error)
+	// Encoded counts an ffmpeg run of rendition which took d
+	Encoded(rendition string, d time.Duration, err error)
+	// Uploaded counts an upload of a file which took d
+	Uploaded(bytes int64, d time.Duration, err error)
+	// Retried counts a repeated cloud operation op
+	Retried(op string)
+}
+
+// Logger describe methods of a leveled structured logger
+type Logger interface {
+	Debug(msg string, fields ...Field)
+	Info(msg string, fields ...Field)
+	Warn(msg string, fields ...Field)
+	Error(msg string, fields ...Field)
+	// With returns a logger which adds fields to every entry
+	With(fields ...Field) Logger
 }
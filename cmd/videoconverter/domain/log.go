@@ -0,0 +1,74 @@
+package domain
+
+import (
+	"context"
+	"time"
+)
+
+// Stages of processing in log entries
+const (
+	StageDownload = "download"
+	StageProbe    = "probe"
+	StageEncode   = "encode"
+	StagePackage  = "package"
+	StageUpload   = "upload"
+	StageSave     = "save"
+	StageCleanup  = "cleanup"
+)
+
+// Field describe a named value of a structured log entry
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// F returns a field with key and value
+func F(key string, value interface{}) Field {
+	return Field{Key: key, Value: value}
+}
+
+// VideoID returns a field with an id of a video
+func VideoID(id int64) Field {
+	return Field{Key: "video_id", Value: id}
+}
+
+// Quality returns a field with a name of a rendition
+func Quality(name string) Field {
+	return Field{Key: "quality", Value: name}
+}
+
+// Stage returns a field with a stage of processing
+func Stage(stage string) Field {
+	return Field{Key: "stage", Value: stage}
+}
+
+// DurationMs returns a field with duration d in milliseconds
+func DurationMs(d time.Duration) Field {
+	return Field{Key: "duration_ms", Value: d.Milliseconds()}
+}
+
+// Err returns a field with a description of err
+func Err(err error) Field {
+	if err == nil {
+		return Field{Key: "error", Value: nil}
+	}
+
+	return Field{Key: "error", Value: err.Error()}
+}
+
+type loggerKey struct{}
+
+// WithLogger returns a copy of ctx which carries logger l,
+// services log through it so entries have fields of the processed video
+func WithLogger(ctx context.Context, l Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, l)
+}
+
+// LoggerFrom returns a logger carried by ctx or def if there is no one
+func LoggerFrom(ctx context.Context, def Logger) Logger {
+	if l, ok := ctx.Value(loggerKey{}).(Logger); ok {
+		return l
+	}
+
+	return def
+}
@@ -1,57 +1,473 @@
 package domain
 
-import "github.com/gocraft/dbr"
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gocraft/dbr"
+	"math"
+	"strings"
+	"time"
+)
 
 // Video describe video entity with required db and business logic fields
 type Video struct {
 	ID int64 `db:"id"`
+	// IBlockID is an id of Bitrix iblock of the video, 0 for other storages
+	IBlockID int64 `db:"iblock_id"`
 
 	IDOrig   dbr.NullInt64  `db:"id_original"`
 	LinkOrig dbr.NullString `db:"link_original"`
 
-	IDPreview   dbr.NullInt64  `db:"id_preview"`
-	LinkPreview dbr.NullString `db:"link_preview"`
+	// Props contains a video property for every rendition property code.
+	// Storage fills it for every known code, so the interactor can update
+	// different properties concurrently without changing the map itself.
+	Props map[string]*Property
 
-	ID1080   dbr.NullInt64  `db:"id_1080"`
-	Link1080 dbr.NullString `db:"link_1080"`
+	FilenameOrig  string
+	LocalPathOrig string
+	CloudDir      string
+	CloudFileOrig string
+	// ForeignOrig is set when the original isn't a file of the cloud, it's downloaded over http and never removed
+	ForeignOrig bool
+	// Version is added to cloud names of made formats so links to formats made again differ
+	// from old ones cached by CDN and players, it's empty when formats are made first time
+	Version string
 
-	ID720   dbr.NullInt64  `db:"id_720"`
-	Link720 dbr.NullString `db:"link_720"`
+	// Media is metadata of the downloaded original, nil if it wasn't probed
+	Media *MediaInfo
+}
 
-	ID480   dbr.NullInt64  `db:"id_480"`
-	Link480 dbr.NullString `db:"link_480"`
+// Property describe a value of a video property in the database
+type Property struct {
+	ID    dbr.NullInt64  `db:"id"`
+	Value dbr.NullString `db:"value"`
+}
 
-	ID360   dbr.NullInt64  `db:"id_360"`
-	Link360 dbr.NullString `db:"link_360"`
+// Link returns a link saved in the property with code
+func (v *Video) Link(code string) string {
+	p, ok := v.Props[code]
+	if !ok {
+		return ""
+	}
 
-	FilenameOrig  string
-	LocalPathOrig string
-	CloudDir      string
+	return p.Value.String
+}
+
+// SetLink sets a link into the property with code
+func (v *Video) SetLink(code, link string) {
+	p, ok := v.Props[code]
+	if !ok {
+		p = &Property{}
+		v.Props[code] = p
+	}
+
+	p.Value = dbr.NewNullString(link)
+}
+
+// Links returns non-empty links of the video by property codes
+func (v *Video) Links() map[string]string {
+	links := make(map[string]string, len(v.Props))
+
+	for code := range v.Props {
+		if link := v.Link(code); link != "" {
+			links[code] = link
+		}
+	}
+
+	return links
 }
 
 // IsFull checks that a video has all required formats
-func (v *Video) IsFull() bool {
-	return v.Link1080.String != "" &&
-		v.Link720.String != "" &&
-		v.Link480.String != "" &&
-		v.Link360.String != "" &&
-		v.LinkPreview.String != ""
-}
-
-func (v *Video) IsHasAnyFormat() bool {
-	return v.Link1080.Valid ||
-		v.Link1080.Valid ||
-		v.Link720.Valid ||
-		v.Link480.Valid ||
-		v.Link360.Valid ||
-		v.LinkPreview.Valid
-}
-
-// QualityProperty describe property ids for every format of video in the database
-type QualityProperty struct {
-	ID1080    int64 `db:"id_1080"`
-	ID720     int64 `db:"id_720"`
-	ID480     int64 `db:"id_480"`
-	ID360     int64 `db:"id_360"`
-	IDPreview int64 `db:"id_preview"`
+func (v *Video) IsFull(codes []string) bool {
+	for _, code := range codes {
+		if v.Link(code) == "" {
+			return false
+		}
+	}
+
+	return true
 }
+
+// IsHasAnyFormat checks that a video has at least one of formats
+func (v *Video) IsHasAnyFormat(codes []string) bool {
+	for _, code := range codes {
+		if p, ok := v.Props[code]; ok && p.Value.Valid {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Missing returns renditions which have no link yet
+func (v *Video) Missing(rr []Rendition) []Rendition {
+	var missing []Rendition
+
+	for _, r := range rr {
+		if v.Link(r.Property) == "" {
+			missing = append(missing, r)
+		}
+	}
+
+	return missing
+}
+
+// MediaInfo describe metadata of a media file
+type MediaInfo struct {
+	Duration time.Duration
+	// Bitrate is an overall bitrate in kb/s
+	Bitrate int
+
+	VideoCodec string
+	Width      int
+	Height     int
+	FPS        float64
+	// Rotation is a clockwise rotation of the video in degrees
+	Rotation int
+
+	Audio []AudioStream
+}
+
+// AudioStream describe an audio stream of a media file
+type AudioStream struct {
+	Codec      string
+	SampleRate int
+	Channels   string
+	// Bitrate in kb/s
+	Bitrate int
+}
+
+// DisplayHeight returns a height of the video as it is shown by players, considering rotation
+func (m *MediaInfo) DisplayHeight() int {
+	if m.Rotation%180 != 0 {
+		return m.Width
+	}
+
+	return m.Height
+}
+
+func (m *MediaInfo) String() string {
+	b := &strings.Builder{}
+
+	fmt.Fprintf(b, "duration %v, bitrate %d kb/s, video %s %dx%d %.2f fps rotation %d",
+		m.Duration, m.Bitrate, m.VideoCodec, m.Width, m.Height, m.FPS, m.Rotation)
+
+	for _, a := range m.Audio {
+		fmt.Fprintf(b, ", audio %s %d Hz %s %d kb/s", a.Codec, a.SampleRate, a.Channels, a.Bitrate)
+	}
+
+	return b.String()
+}
+
+// Rendition describe one output format of a video from the rendition ladder
+type Rendition struct {
+	// Name used in file names and logs, e.g. "1080" or "preview"
+	Name string `json:"name"`
+	// Height of the output video in pixels, the width keeps the aspect ratio
+	Height int `json:"height"`
+	// EncodeProfile is a name of an encoding profile from ENCODE_PROFILES_FILE,
+	// the rendition gets its settings instead of inline ones
+	EncodeProfile string `json:"encode_profile"`
+	Encoding
+	// Property is a code of the database property for a link to the rendition
+	Property string `json:"property"`
+	// Preview marks a short copy of the original instead of a scaled video
+	Preview bool `json:"preview"`
+	// Variant is a name of a group of renditions in an additional codec, e.g. "hevc" or "vp9",
+	// it's empty for the main ladder. Variants aren't packaged into HLS and DASH,
+	// a skipped variant gets a link of a smaller rendition of the same variant.
+	Variant string `json:"variant"`
+}
+
+// Containers of renditions
+const (
+	ContainerMP4  = "mp4"
+	ContainerWebM = "webm"
+)
+
+// Encoding describe ffmpeg settings of video and audio streams of a rendition
+type Encoding struct {
+	Codec string `json:"codec"`
+	// Container is ContainerMP4 or ContainerWebM, it sets an extension of the rendition file
+	Container string `json:"container"`
+	// Profile is a profile of the codec, e.g. "baseline" or "high"
+	Profile string `json:"profile"`
+	// Bitrate is a target video bitrate (e.g. "2500k"), used instead of CRF if set
+	Bitrate string `json:"bitrate"`
+	CRF     int    `json:"crf"`
+	// MaxRate and BufSize limit a peak bitrate of CRF or bitrate encoding (e.g. "3000k" and "6000k")
+	MaxRate string `json:"maxrate"`
+	BufSize string `json:"bufsize"`
+	Preset  string `json:"preset"`
+	// GOP is a max number of frames between key frames, 0 keeps the default of the codec
+	GOP int `json:"gop"`
+
+	AudioCodec   string `json:"audio_codec"`
+	AudioBitrate string `json:"audio_bitrate"`
+	// AudioChannels and AudioSampleRate change the audio of the original if they aren't 0
+	AudioChannels   int `json:"audio_channels"`
+	AudioSampleRate int `json:"audio_sample_rate"`
+}
+
+// Ext returns an extension of files with encoding settings e
+func (e Encoding) Ext() string {
+	if e.Container == ContainerWebM {
+		return ".webm"
+	}
+
+	return ".mp4"
+}
+
+// Packaging describe settings of adaptive streaming output
+// made from all not preview renditions of the main ladder
+type Packaging struct {
+	HLS bool
+	// HLSProperty is a code of the database property for a link to the master playlist
+	HLSProperty string
+
+	DASH bool
+	// DASHProperty is a code of the database property for a link to the MPD manifest
+	DASHProperty string
+
+	// SegmentType is "mpegts" or "fmp4" for HLS without DASH,
+	// with DASH both formats share fMP4 segments
+	SegmentType string
+	// SegmentTime is a target duration of one segment in seconds
+	SegmentTime int
+}
+
+// Codes returns database property codes of enabled packaging formats
+func (p Packaging) Codes() []string {
+	var codes []string
+
+	if p.HLS {
+		codes = append(codes, p.HLSProperty)
+	}
+
+	if p.DASH {
+		codes = append(codes, p.DASHProperty)
+	}
+
+	return codes
+}
+
+// IsEnabled checks that at least one of packaging formats is enabled
+func (p Packaging) IsEnabled() bool {
+	return p.HLS || p.DASH
+}
+
+// Package describe a local directory with segmented renditions and playlists
+type Package struct {
+	Dir string
+	// HLSMaster is a path of the master playlist relative to Dir
+	HLSMaster string
+	// DASHManifest is a path of the MPD manifest relative to Dir
+	DASHManifest string
+}
+
+// Limits describe numbers of concurrent operations of every processing stage
+type Limits struct {
+	// Videos is a number of videos processed at the same time, it limits a number of originals on the disk
+	Videos int
+	// Downloads is a number of concurrent downloads of originals
+	Downloads int
+	// Encodes is a number of concurrent ffmpeg processes
+	Encodes int
+	// Uploads is a number of concurrent uploads to the cloud
+	Uploads int
+}
+
+// EncodeTimeouts describe limits of run time of ffmpeg processes
+type EncodeTimeouts struct {
+	// Factor is a max run time of a process per one rendition in durations of the original, 0 disables the limit
+	Factor float64
+	// Min is a least run time limit, it's used for short videos
+	Min time.Duration
+	// Stall is a max time while a process doesn't advance, 0 disables the check
+	Stall time.Duration
+}
+
+// Timeout returns a run time limit of a process which makes n renditions of an original with duration d,
+// 0 means there is no limit
+func (t EncodeTimeouts) Timeout(d time.Duration, n int) time.Duration {
+	if t.Factor <= 0 || d <= 0 {
+		return 0
+	}
+
+	timeout := time.Duration(float64(d) * t.Factor * float64(n))
+	if timeout < t.Min {
+		return t.Min
+	}
+
+	return timeout
+}
+
+// RetryPolicy describe how failed cloud operations are repeated
+type RetryPolicy struct {
+	// MaxAttempts is a number of attempts including the first one
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	// Jitter is a part of a delay which is randomized, from 0 to 1
+	Jitter float64
+	// StatusCodes are http status codes of responses which can be retried
+	StatusCodes []int
+}
+
+// IsRetryableStatus checks that a response with http status code can be retried
+func (p RetryPolicy) IsRetryableStatus(code int) bool {
+	for _, c := range p.StatusCodes {
+		if c == code {
+			return true
+		}
+	}
+
+	return false
+}
+
+// JobState describe a stage of processing a video or one of its renditions
+type JobState string
+
+const (
+	JobQueued      JobState = "queued"
+	JobDownloading JobState = "downloading"
+	JobEncoding    JobState = "encoding"
+	JobUploading   JobState = "uploading"
+	JobDone        JobState = "done"
+	JobFailed      JobState = "failed"
+	JobCanceled    JobState = "canceled"
+	// JobInterrupted is a job stopped by a shutdown, it's resumed at the next start
+	JobInterrupted JobState = "interrupted"
+)
+
+// IsFinal checks that nothing will happen with a job in this state
+func (s JobState) IsFinal() bool {
+	return s == JobDone || s == JobFailed || s == JobCanceled
+}
+
+// Job describe a state of processing one rendition of a video,
+// a job with empty Rendition describe the video itself
+type Job struct {
+	VideoID   int64     `db:"video_id" json:"video_id"`
+	Rendition string    `db:"rendition" json:"rendition"`
+	State     JobState  `db:"state" json:"state"`
+	Error     string    `db:"error" json:"error,omitempty"`
+	UpdatedAt time.Time `db:"updated_at" json:"updated_at"`
+	// Progress is a progress of the running ffmpeg process of the job, it isn't stored
+	Progress *Progress `db:"-" json:"progress,omitempty"`
+}
+
+// Progress describe a state of a running ffmpeg process read from its -progress output,
+// Percent and ETA are zero if a duration of the input is unknown
+type Progress struct {
+	Frame int64
+	FPS   float64
+	// Speed is a ratio of encoded media time to real time
+	Speed   float64
+	OutTime time.Duration
+	Total   time.Duration
+	Percent float64
+	ETA     time.Duration
+}
+
+// MarshalJSON encodes durations of p in seconds
+func (p Progress) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Percent float64 `json:"percent"`
+		Frame   int64   `json:"frame"`
+		FPS     float64 `json:"fps"`
+		Speed   float64 `json:"speed"`
+		OutTime float64 `json:"out_time"`
+		Total   float64 `json:"total"`
+		ETA     float64 `json:"eta"`
+	}{
+		Percent: math.Round(p.Percent*10) / 10,
+		Frame:   p.Frame,
+		FPS:     p.FPS,
+		Speed:   p.Speed,
+		OutTime: p.OutTime.Seconds(),
+		Total:   p.Total.Seconds(),
+		ETA:     math.Round(p.ETA.Seconds()),
+	})
+}
+
+// VideoFilter describe which videos are processed, the empty filter selects all videos
+type VideoFilter struct {
+	IDs []int64
+	// FromID and ToID limit ids of videos inclusively, 0 means there is no limit
+	FromID int64
+	ToID   int64
+	// Since selects videos modified at or after it, the zero time means any time
+	Since time.Time
+}
+
+// IsEmpty checks that f selects all videos
+func (f VideoFilter) IsEmpty() bool {
+	return len(f.IDs) == 0 && f.FromID == 0 && f.ToID == 0 && f.Since.IsZero()
+}
+
+// IsRequested checks that video with id is requested explicitly by its id
+func (f VideoFilter) IsRequested(id int64) bool {
+	for _, i := range f.IDs {
+		if i == id {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Force describe formats which are made again even if videos already have them
+type Force struct {
+	// All makes all formats again
+	All bool
+	// Names are names of renditions and packaging formats ("hls" or "dash")
+	Names []string
+}
+
+// IsEmpty checks that f doesn't make any format again
+func (f Force) IsEmpty() bool {
+	return !f.All && len(f.Names) == 0
+}
+
+// Has checks that the format name is made again
+func (f Force) Has(name string) bool {
+	if f.All {
+		return true
+	}
+
+	for _, n := range f.Names {
+		if n == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Plan actions
+const (
+	PlanProcess = "process"
+	PlanSkip    = "skip"
+)
+
+// PlanItem describe what a run would do with one video
+type PlanItem struct {
+	VideoID int64  `json:"video_id"`
+	Action  string `json:"action"`
+	// Reason is a description why the video is skipped
+	Reason string `json:"reason,omitempty"`
+	// Resumed is set for a video which processing was interrupted, it's processed first
+	Resumed bool `json:"resumed"`
+	// Missing are names of renditions and packaging formats which would be made
+	Missing []string `json:"missing"`
+	// Forced are names of formats which the video has but they would be made again
+	Forced []string `json:"forced,omitempty"`
+	// Encodes is a max number of ffmpeg runs, renditions taller than the original are skipped
+	// after it's downloaded
+	Encodes int `json:"encodes"`
+}
+
+// PropertyIDs describe property ids for every format of video in the database
+// by property code
+type PropertyIDs map[string]int64
@@ -0,0 +1,21 @@
+package domain
+
+import "context"
+
+// ProgressFunc receives progress of a running ffmpeg process, it's called from one goroutine
+type ProgressFunc func(p Progress)
+
+type progressKey struct{}
+
+// WithProgress returns a copy of ctx which carries fn, the encoder reports progress
+// of processes started with ctx to it
+func WithProgress(ctx context.Context, fn ProgressFunc) context.Context {
+	return context.WithValue(ctx, progressKey{}, fn)
+}
+
+// ProgressFrom returns a progress callback carried by ctx or nil if there is no one
+func ProgressFrom(ctx context.Context) ProgressFunc {
+	fn, _ := ctx.Value(progressKey{}).(ProgressFunc)
+
+	return fn
+}
@@ -3,8 +3,23 @@ module videoconverter
 go 1.17
 
 require (
-	github.com/go-sql-driver/mysql v1.6.0 // indirect
-	github.com/gocraft/dbr v0.0.0-20190714181702-8114670a83bd // indirect
-	github.com/joho/godotenv v1.4.0 // indirect
-	github.com/pkg/errors v0.9.1 // indirect
+	github.com/go-sql-driver/mysql v1.6.0
+	github.com/gocraft/dbr v0.0.0-20190714181702-8114670a83bd
+	github.com/joho/godotenv v1.4.0
+	github.com/lib/pq v1.10.9
+	github.com/mattn/go-sqlite3 v1.14.16
+	github.com/pkg/errors v0.9.1
+	github.com/prometheus/client_golang v1.12.2
+	github.com/prometheus/client_model v0.2.0
+)
+
+require (
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.1.2 // indirect
+	github.com/golang/protobuf v1.5.2 // indirect
+	github.com/matttproud/golang_protobuf_extensions v1.0.1 // indirect
+	github.com/prometheus/common v0.32.1 // indirect
+	github.com/prometheus/procfs v0.7.3 // indirect
+	golang.org/x/sys v0.0.0-20220114195835-da31bd327af9 // indirect
+	google.golang.org/protobuf v1.26.0 // indirect
 )
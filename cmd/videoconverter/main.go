@@ -2,15 +2,23 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"github.com/gocraft/dbr"
 	"github.com/pkg/errors"
+	"io"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
 	"runtime"
+	"strconv"
+	"strings"
 	"syscall"
+	"text/tabwriter"
 	"time"
+	"videoconverter/api"
 	"videoconverter/bootstrap"
 	"videoconverter/domain"
 	"videoconverter/domain/interactor"
@@ -18,6 +26,8 @@ import (
 
 	_ "embed"
 	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
 )
 
 //go:embed ffmpeg-4-2-4
@@ -25,20 +35,46 @@ var ffmpeg []byte
 
 func main() {
 	pathToConfig := flag.String("c", "./.env", "path to .env config")
+	isServe := flag.Bool("serve", false, "run as a server with REST API instead of processing all videos once")
+	isDryRun := flag.Bool("dry-run", false, "print which videos and formats would be processed without processing them")
+	format := flag.String("format", "table", "format of the dry run plan: table or json")
+	ids := flag.String("id", "", "comma-separated ids of videos to process instead of all videos")
+	fromID := flag.Int64("from-id", 0, "process videos with ids from this one inclusively")
+	toID := flag.Int64("to-id", 0, "process videos with ids up to this one inclusively")
+	since := flag.String("since", "", "process videos modified since a time: RFC3339, 2006-01-02, 2006-01-02 15:04:05 or a duration ago like 24h")
+	forced := flag.String("force", "", "comma-separated renditions, hls or dash to make again even if videos have them, or all")
 	flag.Parse()
+
+	if *format != "table" && *format != "json" {
+		log.Fatalln("Unknown plan format:", *format)
+	}
+
+	filter, err := newFilter(*ids, *fromID, *toID, *since, time.Now())
+	if err != nil {
+		log.Fatalln("Video filter:", err)
+	}
+
+	if *isServe && !filter.IsEmpty() {
+		log.Fatalln("Video filter: the server mode processes videos requested by the API only")
+	}
+
+	force := newForce(*forced)
+	if *isServe && !force.IsEmpty() {
+		log.Fatalln("Force: the server mode makes formats again by the API only")
+	}
+
+	if *isServe && *isDryRun {
+		log.Fatalln("Dry run: the server mode has no plan, videos are requested by the API")
+	}
 	now := time.Now()
 
-	shutdown := make(chan os.Signal, 0)
+	shutdown := make(chan os.Signal, 1)
 	signal.Notify(shutdown, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT, syscall.SIGSTOP)
-	defer close(shutdown)
+	defer signal.Stop(shutdown)
 
-	channels := map[int]chan int{
-		domain.ChDone:         make(chan int),
-		domain.ChAll:          make(chan int),
-		domain.ChConverted:    make(chan int),
-		domain.ChNotConverted: make(chan int),
-		domain.ChUploaded:     make(chan int),
-	}
+	fatal := make(chan struct{}, 1)
+	finished := make(chan struct{})
+	metrics := service.NewMetrics()
 
 	// configs
 	c, err := bootstrap.New(*pathToConfig)
@@ -46,14 +82,39 @@ func main() {
 		log.Fatalln("Config load:", err)
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Hour*time.Duration(c.Timeout))
+	if *isServe && c.API.Token == "" {
+		log.Fatalln("API: API_TOKEN is required in the server mode")
+	}
+
+	if *isDryRun {
+		dryRun(c, filter, force, *format)
+		return
+	}
+
+	// ctx stops taking new videos: the server mode works until a signal, TIMEOUT limits a one-shot run only.
+	// work interrupts running videos when the grace period of a shutdown is over.
+	var ctx context.Context
+	var cancel context.CancelFunc
+
+	if *isServe {
+		ctx, cancel = context.WithCancel(context.Background())
+	} else {
+		ctx, cancel = context.WithTimeout(context.Background(), time.Hour*time.Duration(c.Timeout))
+	}
 	defer cancel()
 
-	logger, err := bootstrap.NewLog(c.ENV, c.LogDir)
+	work, interrupt := context.WithCancel(context.Background())
+	defer interrupt()
+
+	logger, err := bootstrap.NewLog(c.ENV, c.LogDir, c.LogLevel, c.LogRotate)
 	if err != nil {
 		log.Fatalln("Logfile error: ", err)
 	}
 
+	if err := c.MakeTemp(); err != nil {
+		log.Fatalln("Temp dir:", err)
+	}
+
 	f, err := bootstrap.ExtractFfmpeg(ffmpeg)
 	if err != nil {
 		log.Fatalln("Не удалось распаковать ffmpeg")
@@ -62,17 +123,14 @@ func main() {
 	defer func() {
 		f.Close()
 		os.Remove(f.Name())
-		os.RemoveAll(c.Temp)
 
 		timeFinish := time.Since(now)
-		logger.D(fmt.Sprintf("Program is finished %v", timeFinish))
+		logger.Info("program is finished", domain.DurationMs(timeFinish))
 
 		if err := logger.Close(); err != nil {
 			log.Println("Logfile close error: ", err)
 		}
 
-		closeChannels(channels)
-
 		logger.Close()
 	}()
 
@@ -90,85 +148,310 @@ func main() {
 
 	defer conn.Close()
 
-	httpClient, cloudAuthData, err := bootstrap.InitCloud(c.Cloud.Login, c.Cloud.Password)
+	backend, err := newCloud(c.Cloud, logger, true)
 	if err != nil {
 		log.Fatalln("Cloud connection:", err)
 	}
 
 	// services
-	storage := service.NewStorage(conn)
-	cloud := service.NewCloud(ctx, httpClient, cloudAuthData.Token, cloudAuthData.OwnerID, logger)
-	encode := service.NewEncoder(ctx, f.Name(), c.ThreadFfmpegMax, logger)
+	storage, err := newStorage(conn, c.Storage, c.Bitrix, append(domain.PropertyCodes(c.Renditions), c.Packaging.Codes()...), true)
+	if err != nil {
+		log.Fatalln("Storage:", err)
+	}
+
+	jobs := service.NewJobStorage(conn)
+	cloud := service.NewRetryCloud(backend, c.Retry, metrics, logger)
+	// renditions get key frames at boundaries of segments to be packaged without re-encoding
+	var keyInterval int
+	if c.Packaging.IsEnabled() {
+		keyInterval = c.Packaging.SegmentTime
+	}
+
+	encode := service.NewEncoder(f.Name(), c.ThreadFfmpegMax, keyInterval, logger)
+
+	if err := encode.CheckEncoders(ctx, c.Renditions); err != nil {
+		log.Fatalln("Encoders:", err)
+	}
+
+	if err := jobs.Migrate(); err != nil {
+		log.Fatalln("Jobs table:", err)
+	}
 
 	// interactors
-	vi := interactor.NewVideoCase(channels, c.ENV, c.Temp, c.RmOriginal, c.SkipNotFull, storage, cloud, encode, logger)
-	go vi.Start(ctx)
+	vi := interactor.NewVideoCase(fatal, c.ENV, c.Temp, c.RmOriginal, c.RmReplaced, c.SkipNotFull, c.Renditions, c.Packaging, c.SinglePass, c.Limits, c.EncodeTimeouts, storage, jobs, cloud, encode, metrics, logger)
 
-	// handle signals, channels
-	var result resultData
-	go listen(ctx, channels, &result)
+	if err := vi.CheckForce(force); err != nil {
+		log.Fatalln("Force:", err)
+	}
+
+	var server *api.Server
+	serverErr := make(chan error, 1)
+
+	if c.MetricsAddr != "" {
+		go func() {
+			serverErr <- http.ListenAndServe(c.MetricsAddr, metrics.Handler())
+		}()
+	}
+
+	if *isServe {
+		server = api.NewServer(c.API.Addr, c.API.Token, vi, jobs, metrics.Handler(), logger)
+
+		go func() {
+			vi.Serve(ctx, work)
+			close(finished)
+		}()
+		go func() {
+			serverErr <- server.ListenAndServe()
+		}()
+	} else {
+		go func() {
+			vi.Start(ctx, work, filter, force)
+			close(finished)
+		}()
+	}
 
 	select {
 	case <-ctx.Done():
-		logger.D(fmt.Sprintf("Программа останавливливается по таймауту"))
+		logger.Warn("program is stopping by timeout")
 	case sig := <-shutdown:
-		logger.E(fmt.Sprintf("Внеплановое завершение программы по сигналу %d", sig))
-	case <-channels[domain.ChDone]:
-		logger.D(fmt.Sprintf("Программа штатно завершилась"))
-	}
-
-	if err := result.Error(); err != nil {
-		logger.E(fmt.Sprintf(`
-			Получено видео: %d
-			Сконвертировано: %d
-			Не сконвертировано: %d
-			Загружено на облако: %d
-			Не загружено на облако: %d`,
-			result.All,
-			result.Converted,
-			result.NotConverted,
-			result.Uploaded,
-			result.NotUploaded))
+		logger.Warn("program is stopping by signal", domain.F("signal", sig.String()))
+	case <-fatal:
+		logger.Error("program is stopping by a database error")
+		interrupt()
+	case <-finished:
+		logger.Info("program is finished normally")
+	case err := <-serverErr:
+		logger.Error("API server failed", domain.Err(err))
+	}
+
+	cancel()
+
+	if server != nil {
+		shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), 5*time.Second)
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			logger.Error("can't stop API server", domain.Err(err))
+		}
+		cancelShutdown()
+	}
+
+	// running videos may finish during the grace period, others are interrupted and resumed at the next start
+	select {
+	case <-finished:
+	default:
+		logger.Info("waiting for running videos", domain.F("grace_ms", c.ShutdownGrace.Milliseconds()))
+
+		grace := time.NewTimer(c.ShutdownGrace)
+
+		select {
+		case <-finished:
+		case <-grace.C:
+			logger.Warn("grace period is over, interrupting running videos")
+		case sig := <-shutdown:
+			logger.Warn("interrupting running videos by signal", domain.F("signal", sig.String()))
+		}
+
+		grace.Stop()
+		interrupt()
+		<-finished
+	}
+
+	result := metrics.Summary()
+	summary := []domain.Field{
+		domain.F("videos", result.Videos),
+		domain.F("encoded", result.Encoded),
+		domain.F("not_encoded", result.NotEncoded),
+		domain.F("uploaded", result.Uploaded),
+		domain.F("not_uploaded", result.NotUploaded),
+		domain.F("not_downloaded", result.NotDownloaded),
+		domain.F("retried", result.Retried),
+		domain.F("bytes_downloaded", result.BytesDownloaded),
+		domain.F("bytes_uploaded", result.BytesUploaded),
+	}
+
+	if result.NotEncoded > 0 || result.NotUploaded > 0 || result.NotDownloaded > 0 {
+		logger.Error("processing finished with errors", summary...)
+		return
+	}
+
+	logger.Info("processing finished", summary...)
+}
+
+// dryRun prints the plan of processing videos selected by filter and formats of force in format,
+// it only reads videos and jobs: no logfile, temp dir, ffmpeg and cloud login. Logs are printed to stderr.
+func dryRun(c *bootstrap.App, filter domain.VideoFilter, force domain.Force, format string) {
+	logger := bootstrap.NewConsoleLog(c.ENV, c.LogLevel, os.Stderr)
+
+	conn, err := bootstrap.Open(c.DB)
+	if err != nil {
+		log.Fatalln("Database connection:", err)
+	}
+
+	defer conn.Close()
+
+	backend, err := newCloud(c.Cloud, logger, false)
+	if err != nil {
+		log.Fatalln("Cloud:", err)
+	}
+
+	storage, err := newStorage(conn, c.Storage, c.Bitrix, append(domain.PropertyCodes(c.Renditions), c.Packaging.Codes()...), false)
+	if err != nil {
+		log.Fatalln("Storage:", err)
+	}
+
+	jobs := service.NewJobStorage(conn)
+	vi := interactor.NewVideoCase(nil, c.ENV, c.Temp, c.RmOriginal, c.RmReplaced, c.SkipNotFull, c.Renditions, c.Packaging, c.SinglePass, c.Limits, c.EncodeTimeouts, storage, jobs, backend, nil, service.NewMetrics(), logger)
+
+	if err := vi.CheckForce(force); err != nil {
+		log.Fatalln("Force:", err)
+	}
+
+	plan, err := vi.Plan(filter, force)
+	if err != nil {
+		log.Fatalln("Plan:", err)
+	}
+
+	if err := printPlan(os.Stdout, plan, format); err != nil {
+		log.Fatalln("Plan:", err)
 	}
 }
 
-type resultData struct {
-	All          int
-	Converted    int
-	NotConverted int
-	Uploaded     int
-	NotUploaded  int
+// newCloud returns a cloud backend chosen by configuration, platformcraft is logged in only if isLogin is set,
+// otherwise it can only resolve paths of links
+func newCloud(c bootstrap.Cloud, logger *bootstrap.Logger, isLogin bool) (domain.Clouder, error) {
+	switch c.Backend {
+	case bootstrap.CloudS3:
+		return service.NewS3(&http.Client{}, c.S3, logger)
+	case bootstrap.CloudFS:
+		return service.NewFileCloud(c.FS, logger)
+	}
+
+	if !isLogin {
+		return service.NewCloud(&http.Client{}, "", "", logger), nil
+	}
+
+	httpClient, cloudAuthData, err := bootstrap.InitCloud(c.Login, c.Password)
+	if err != nil {
+		return nil, err
+	}
+
+	return service.NewCloud(httpClient, cloudAuthData.Token, cloudAuthData.OwnerID, logger), nil
 }
 
-func (r *resultData) Error() error {
-	if r.NotConverted > 0 || r.NotUploaded > 0 {
-		return errors.New("произошли ошибки обработки")
+// newStorage returns a metadata storage chosen by configuration,
+// tables of the generic storage are created if isMigrate is set
+func newStorage(conn *dbr.Connection, storage string, bitrix bootstrap.Bitrix, codes []string, isMigrate bool) (domain.Storager, error) {
+	if storage == bootstrap.StorageGeneric {
+		s := service.NewGenericStorage(conn, codes)
+		if !isMigrate {
+			return s, nil
+		}
+
+		return s, s.Migrate()
 	}
 
-	return nil
+	return service.NewStorage(conn, bitrix, codes), nil
 }
 
-func listen(ctx context.Context, ch map[int]chan int, data *resultData) {
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case i := <-ch[domain.ChAll]:
-			data.All += i
-		case i := <-ch[domain.ChConverted]:
-			data.Converted += i
-		case i := <-ch[domain.ChNotConverted]:
-			data.NotConverted += i
-		case i := <-ch[domain.ChUploaded]:
-			data.Uploaded += i
-		case i := <-ch[domain.ChNotUploaded]:
-			data.NotUploaded += i
+// newFilter returns a filter of processed videos by command line flags, since is parsed in the local time zone
+// or is a duration before now
+func newFilter(ids string, fromID, toID int64, since string, now time.Time) (domain.VideoFilter, error) {
+	f := domain.VideoFilter{FromID: fromID, ToID: toID}
+
+	for _, s := range strings.Split(ids, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+
+		id, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || id <= 0 {
+			return f, errors.Errorf("invalid video id %q", s)
+		}
+
+		f.IDs = append(f.IDs, id)
+	}
+
+	if fromID < 0 || toID < 0 || toID > 0 && fromID > toID {
+		return f, errors.Errorf("invalid id range %d-%d", fromID, toID)
+	}
+
+	if since == "" {
+		return f, nil
+	}
+
+	if d, err := time.ParseDuration(since); err == nil && d > 0 {
+		f.Since = now.Add(-d)
+		return f, nil
+	}
+
+	for _, layout := range []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, since, time.Local); err == nil {
+			f.Since = t
+			return f, nil
 		}
 	}
+
+	return f, errors.Errorf("invalid time %q", since)
 }
 
-func closeChannels(ch map[int]chan int) {
-	for _, v := range ch {
-		close(v)
+// newForce returns formats which are made again by the -force flag value s
+func newForce(s string) domain.Force {
+	var f domain.Force
+
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+
+		switch name {
+		case "":
+		case "all":
+			f.All = true
+		default:
+			f.Names = append(f.Names, name)
+		}
 	}
+
+	return f
+}
+
+// printPlan writes plan as a table with a summary of work or as JSON
+func printPlan(w io.Writer, plan []domain.PlanItem, format string) error {
+	if format == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+
+		return enc.Encode(plan)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "VIDEO\tACTION\tRESUMED\tMISSING\tFORCED\tFFMPEG RUNS\tREASON")
+
+	var videos, formats, runs int
+
+	for _, p := range plan {
+		missing := strings.Join(p.Missing, ",")
+		if missing == "" {
+			missing = "-"
+		}
+
+		forced := strings.Join(p.Forced, ",")
+		if forced == "" {
+			forced = "-"
+		}
+
+		fmt.Fprintf(tw, "%d\t%s\t%t\t%s\t%s\t%d\t%s\n", p.VideoID, p.Action, p.Resumed, missing, forced, p.Encodes, p.Reason)
+
+		if p.Action == domain.PlanProcess {
+			videos++
+			formats += len(p.Missing)
+			runs += p.Encodes
+		}
+	}
+
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	_, err := fmt.Fprintf(w, "\nvideos: %d, to process: %d, formats: %d, ffmpeg runs: up to %d\n", len(plan), videos, formats, runs)
+
+	return err
 }
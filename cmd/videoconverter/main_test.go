@@ -0,0 +1,131 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+	"videoconverter/domain"
+)
+
+func TestNewFilter(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		ids     string
+		fromID  int64
+		toID    int64
+		since   string
+		want    domain.VideoFilter
+		wantErr bool
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name: "ids with spaces",
+			ids:  "42, 43,,44",
+			want: domain.VideoFilter{IDs: []int64{42, 43, 44}},
+		},
+		{
+			name:    "invalid id",
+			ids:     "42,abc",
+			wantErr: true,
+		},
+		{
+			name:    "zero id",
+			ids:     "0",
+			wantErr: true,
+		},
+		{
+			name:   "id range",
+			fromID: 100,
+			toID:   200,
+			want:   domain.VideoFilter{FromID: 100, ToID: 200},
+		},
+		{
+			name:   "open id range",
+			fromID: 100,
+			want:   domain.VideoFilter{FromID: 100},
+		},
+		{
+			name:    "reversed id range",
+			fromID:  200,
+			toID:    100,
+			wantErr: true,
+		},
+		{
+			name:    "negative id",
+			fromID:  -1,
+			wantErr: true,
+		},
+		{
+			name:  "duration",
+			since: "24h",
+			want:  domain.VideoFilter{Since: now.Add(-24 * time.Hour)},
+		},
+		{
+			name:  "date in the local time",
+			since: "2026-10-01",
+			want:  domain.VideoFilter{Since: time.Date(2026, 10, 1, 0, 0, 0, 0, time.Local)},
+		},
+		{
+			name:  "date and time in the local time",
+			since: "2026-10-01 12:30:00",
+			want:  domain.VideoFilter{Since: time.Date(2026, 10, 1, 12, 30, 0, 0, time.Local)},
+		},
+		{
+			name:  "rfc3339",
+			since: "2026-10-01T12:00:00Z",
+			want:  domain.VideoFilter{Since: time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)},
+		},
+		{
+			name:    "negative duration",
+			since:   "-24h",
+			wantErr: true,
+		},
+		{
+			name:    "invalid time",
+			since:   "yesterday",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := newFilter(tt.ids, tt.fromID, tt.toID, tt.since, now)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("newFilter() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if tt.wantErr {
+				return
+			}
+
+			if !reflect.DeepEqual(got.IDs, tt.want.IDs) || got.FromID != tt.want.FromID || got.ToID != tt.want.ToID ||
+				!got.Since.Equal(tt.want.Since) {
+				t.Errorf("newFilter() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewForce(t *testing.T) {
+	tests := []struct {
+		s    string
+		want domain.Force
+	}{
+		{s: ""},
+		{s: "all", want: domain.Force{All: true}},
+		{s: "1080, hls,", want: domain.Force{Names: []string{"1080", "hls"}}},
+		{s: "720,all", want: domain.Force{All: true, Names: []string{"720"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.s, func(t *testing.T) {
+			if got := newForce(tt.s); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("newForce() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
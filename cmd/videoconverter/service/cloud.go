@@ -9,8 +9,9 @@ import (
 	"io"
 	"mime/multipart"
 	"net/http"
+	"net/url"
 	"os"
-	"videoconverter/bootstrap"
+	"strings"
 	"videoconverter/domain"
 )
 
@@ -21,22 +22,30 @@ const (
 var (
 	ErrFreeSpace    = errors.New("на облаке кончилось место")
 	ErrNotFullWrite = errors.New("файл был загружен не полностью")
+	ErrChecksum     = errors.New("контрольная сумма файла не совпадает с ETag")
 )
 
+// StatusError describe an unexpected http status code of a cloud response
+type StatusError struct {
+	Code int
+}
+
+func (e StatusError) Error() string {
+	return fmt.Sprintf("reponse code is %d", e.Code)
+}
+
 // Cloud describe a remote file cloud
 type Cloud struct {
-	ctx     context.Context
 	client  *http.Client
 	token   string
 	ownerID string
 
-	l *bootstrap.Logger
+	l domain.Logger
 }
 
 // NewCloud returns ready for use *Cloud instance
-func NewCloud(ctx context.Context, client *http.Client, token, ownerID string, l *bootstrap.Logger) *Cloud {
+func NewCloud(client *http.Client, token, ownerID string, l domain.Logger) *Cloud {
 	return &Cloud{
-		ctx:     ctx,
 		client:  client,
 		token:   token,
 		ownerID: ownerID,
@@ -46,69 +55,32 @@ func NewCloud(ctx context.Context, client *http.Client, token, ownerID string, l
 
 // DownloadFile downloads a file from url u into file f
 // Use for downloading an original file for next converting
-func (c *Cloud) DownloadFile(u string, f *os.File) error {
-	req, err := http.NewRequest(http.MethodGet, u, nil)
-	if err != nil {
-		return errors.WithStack(err)
-	}
-
-	req = req.WithContext(c.ctx)
-
-	r, err := c.client.Do(req)
-	if err != nil {
-		return errors.WithStack(err)
-	}
-
-	defer r.Body.Close()
-
-	if r.StatusCode != http.StatusOK {
-		return errors.Errorf("reponse code is %d", r.StatusCode)
-	}
-
-	n, err := io.Copy(f, r.Body)
-	if err != nil {
-		return errors.WithStack(err)
-	}
-
-	if n < r.ContentLength {
-		return errors.WithStack(ErrNotFullWrite)
-	}
-
-	return nil
+func (c *Cloud) DownloadFile(ctx context.Context, u string, f *os.File) error {
+	return download(ctx, c.client, u, f, nil, c.l)
 }
 
-// UploadFile uploads a converted file to the cloud
-func (c *Cloud) UploadFile(path string, f *os.File) (string, error) {
+// UploadFile uploads a converted file to the cloud.
+// The file is streamed from the disk, so memory usage doesn't depend on the file size.
+func (c *Cloud) UploadFile(ctx context.Context, path string, f *os.File) (string, error) {
 	apiResponse := make(map[string]interface{})
 
-	var body bytes.Buffer
-
-	w := multipart.NewWriter(&body)
-
-	wr, err := w.CreateFormFile("file", f.Name())
+	body, contentType, size, err := multipartBody(f)
 	if err != nil {
 		return "", err
 	}
 
-	n, err := io.Copy(wr, f)
-	if err != nil {
-		return "", err
-	}
-
-	w.Close()
-
 	uri := fmt.Sprintf("%s/%s/object/videoconverter/%s", apiURL, c.ownerID, path)
 
-	req, err := http.NewRequest(http.MethodPost, uri, bytes.NewReader(body.Bytes()))
+	req, err := http.NewRequest(http.MethodPost, uri, body)
 	if err != nil {
 		return "", errors.WithStack(err)
 	}
 
-	req = req.WithContext(c.ctx)
+	req = req.WithContext(ctx)
 
+	req.ContentLength = size
 	req.Header.Add("Authorization", "Bearer "+c.token)
-	req.Header.Add("Content-Type", w.FormDataContentType())
-	req.Header.Add("Content-Length", fmt.Sprintf("%d", n))
+	req.Header.Add("Content-Type", contentType)
 
 	res, err := c.client.Do(req)
 	if err != nil {
@@ -117,7 +89,7 @@ func (c *Cloud) UploadFile(path string, f *os.File) (string, error) {
 
 	defer func() {
 		if err := res.Body.Close(); err != nil {
-			c.l.E(fmt.Sprintln("can't close response body ", err))
+			c.l.Warn("can't close response body", domain.Err(err))
 		}
 	}()
 
@@ -130,8 +102,7 @@ func (c *Cloud) UploadFile(path string, f *os.File) (string, error) {
 	}
 
 	if res.StatusCode != http.StatusOK {
-		return "", errors.WithMessagef(err, "reponse code is %d", res.StatusCode)
-
+		return "", errors.WithStack(StatusError{res.StatusCode})
 	}
 
 	err = json.NewDecoder(res.Body).Decode(&apiResponse)
@@ -148,9 +119,57 @@ func (c *Cloud) UploadFile(path string, f *os.File) (string, error) {
 	return "https://" + u.(string), nil
 }
 
+// multipartBody returns a multipart/form-data body with file f as "file" field,
+// its content type and exact length. Only the multipart head and tail are kept in memory,
+// the file is read from its current position while the body is sent.
+func multipartBody(f *os.File) (io.Reader, string, int64, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, "", 0, errors.WithStack(err)
+	}
+
+	offset, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, "", 0, errors.WithStack(err)
+	}
+
+	var buf bytes.Buffer
+
+	w := multipart.NewWriter(&buf)
+
+	if _, err := w.CreateFormFile("file", f.Name()); err != nil {
+		return nil, "", 0, errors.WithStack(err)
+	}
+
+	head := make([]byte, buf.Len())
+	copy(head, buf.Bytes())
+	buf.Reset()
+
+	if err := w.Close(); err != nil {
+		return nil, "", 0, errors.WithStack(err)
+	}
+
+	tail := buf.Bytes()
+	size := int64(len(head)) + info.Size() - offset + int64(len(tail))
+
+	body := io.MultiReader(bytes.NewReader(head), io.LimitReader(f, info.Size()-offset), bytes.NewReader(tail))
+
+	return body, w.FormDataContentType(), size, nil
+}
+
+// Path returns a path of the file with link u in the cloud
+func (c *Cloud) Path(u string) (string, error) {
+	cURL, err := url.Parse(u)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	return strings.ReplaceAll(cURL.Path, "/synergy/", ""), nil
+}
+
 // Delete deletes a converted file from the cloud
 // Use for delete large original files after converting to all required formats
-func (c *Cloud) Delete(filepath string) error {
+func (c *Cloud) Delete(ctx context.Context, filepath string) error {
 	uri := fmt.Sprintf("%s/%s/object/%s", apiURL, c.ownerID, filepath)
 
 	req, err := http.NewRequest(http.MethodDelete, uri, nil)
@@ -161,22 +180,22 @@ func (c *Cloud) Delete(filepath string) error {
 	req.Header.Add("Content-Type", "multipart/form-data")
 	req.Header.Add("Authorization", "Bearer "+c.token)
 
-	req = req.WithContext(c.ctx)
+	req = req.WithContext(ctx)
 
 	res, err := c.client.Do(req)
 	if err != nil {
 		return errors.WithStack(err)
 	}
 
-	if res.StatusCode != http.StatusOK {
-		return errors.WithStack(err)
-	}
-
 	defer func() {
 		if err := res.Body.Close(); err != nil {
-			c.l.E(fmt.Sprintln("can't close response body ", err))
+			c.l.Warn("can't close response body", domain.Err(err))
 		}
 	}()
 
+	if res.StatusCode != http.StatusOK {
+		return errors.WithStack(StatusError{res.StatusCode})
+	}
+
 	return nil
 }
@@ -3,77 +3,173 @@ package service
 import (
 	"github.com/gocraft/dbr"
 	"github.com/pkg/errors"
+	"strings"
+	"sync"
+	"videoconverter/bootstrap"
 	"videoconverter/domain"
 )
 
+// Storage keeps videos in Bitrix iblock tables
 type Storage struct {
-	db   *dbr.Connection
-	qIDs *domain.QualityProperty
+	db     *dbr.Connection
+	bitrix bootstrap.Bitrix
+	codes  []string
+
+	mu    sync.Mutex
+	ibIDs []int64
+	// pIDs contains property ids by iblock id
+	pIDs map[int64]domain.PropertyIDs
+
+	// insertMu serializes inserts, because a new id is calculated from the max one
+	insertMu sync.Mutex
 }
 
-// NewStorage returns a ready for use instance of Storage
-func NewStorage(dbConn *dbr.Connection) *Storage {
+// NewStorage returns a ready for use instance of Storage,
+// bitrix describe iblocks with videos, codes are property codes of all renditions
+func NewStorage(dbConn *dbr.Connection, bitrix bootstrap.Bitrix, codes []string) *Storage {
 	return &Storage{
-		db: dbConn,
+		db:     dbConn,
+		bitrix: bitrix,
+		codes:  codes,
 	}
 }
 
-// Videos get all videos
+// videoProperty describe a row of a rendition property of a video
+type videoProperty struct {
+	ElementID int64          `db:"element_id"`
+	Code      string         `db:"code"`
+	ID        dbr.NullInt64  `db:"id"`
+	Value     dbr.NullString `db:"value"`
+}
+
+// Videos get all videos of all configured iblocks
 func (s *Storage) Videos() ([]domain.Video, error) {
+	return s.videos(domain.VideoFilter{})
+}
+
+// FilterVideos get videos of configured iblocks selected by f,
+// the modification time is a time of the last update of the iblock element
+func (s *Storage) FilterVideos(f domain.VideoFilter) ([]domain.Video, error) {
+	return s.videos(f)
+}
+
+// Video get a video of configured iblocks by id
+func (s *Storage) Video(id int64) (*domain.Video, error) {
+	v, err := s.videos(domain.VideoFilter{IDs: []int64{id}})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(v) == 0 {
+		return nil, errors.WithStack(domain.ErrNotFound)
+	}
+
+	return &v[0], nil
+}
+
+// videos get videos of configured iblocks selected by f
+func (s *Storage) videos(f domain.VideoFilter) ([]domain.Video, error) {
+	iblockIDs, err := s.IBlockIDs()
+	if err != nil {
+		return []domain.Video{}, err
+	}
+
 	var v []domain.Video
 
-	_, err := s.db.NewSession(nil).
+	filter, filterArgs := elementFilter(f)
+	session := s.db.NewSession(nil)
+
+	_, err = session.
 		SelectBySql(`
 SELECT 
   p.IBLOCK_ELEMENT_ID id,
+  bip.IBLOCK_ID iblock_id,
   p.ID AS id_original,
-  p.VALUE AS link_original,
-  p360.ID AS id_360,
-  p360.VALUE AS link_360,
-  p480.ID AS id_480,
-  p480.VALUE AS link_480,
-  p720.ID AS id_720,
-  p720.VALUE AS link_720,
-  p1080.ID AS id_1080,
-  p1080.VALUE AS link_1080,
-  preview.ID AS id_preview,
-  preview.VALUE AS link_preview
-FROM b_iblock
-  JOIN b_iblock_property bip
-    ON bip.IBLOCK_ID = b_iblock.ID AND bip.CODE = 'VIDEO_LINK'
-  JOIN b_iblock_property bip360
-    ON bip360.IBLOCK_ID = b_iblock.ID AND bip360.CODE = 'VIDEO_LINK_360p'
-  JOIN b_iblock_property bip480
-    ON bip480.IBLOCK_ID = b_iblock.ID AND bip480.CODE = 'VIDEO_LINK_480p'
-  JOIN b_iblock_property bip720
-    ON bip720.IBLOCK_ID = b_iblock.ID AND bip720.CODE = 'VIDEO_LINK_720p'
-  JOIN b_iblock_property bip1080
-    ON bip1080.IBLOCK_ID = b_iblock.ID AND bip1080.CODE = 'VIDEO_LINK_1080p'
-  JOIN b_iblock_property bipPreview
-    ON bipPreview.IBLOCK_ID = b_iblock.ID and bipPreview.CODE = 'VIDEO_LINK_PREVIEW'
-  LEFT JOIN b_iblock_element_property AS p
+  p.VALUE AS link_original
+FROM b_iblock_property bip
+  JOIN b_iblock_element_property AS p
     ON p.IBLOCK_PROPERTY_ID = bip.ID
-  LEFT JOIN b_iblock_element_property AS p360
-    ON p360.IBLOCK_PROPERTY_ID = bip360.ID AND p360.IBLOCK_ELEMENT_ID = p.IBLOCK_ELEMENT_ID
-  LEFT JOIN b_iblock_element_property AS p480
-    ON p480.IBLOCK_PROPERTY_ID = bip480.ID AND p480.IBLOCK_ELEMENT_ID = p.IBLOCK_ELEMENT_ID
-  LEFT JOIN b_iblock_element_property AS p720
-    ON p720.IBLOCK_PROPERTY_ID = bip720.ID AND p720.IBLOCK_ELEMENT_ID = p.IBLOCK_ELEMENT_ID
-  LEFT JOIN b_iblock_element_property AS p1080
-    ON p1080.IBLOCK_PROPERTY_ID = bip1080.ID AND p1080.IBLOCK_ELEMENT_ID = p.IBLOCK_ELEMENT_ID
-  LEFT JOIN b_iblock_element_property AS preview
-    ON preview.IBLOCK_PROPERTY_ID = bipPreview.ID AND preview.IBLOCK_ELEMENT_ID = p.IBLOCK_ELEMENT_ID
-WHERE b_iblock.CODE = 'lessons' AND b_iblock.IBLOCK_TYPE_ID = 'content'
-`).
+WHERE bip.IBLOCK_ID IN ? AND bip.CODE = ?`+filter,
+			append([]interface{}{iblockIDs, s.bitrix.OriginalProperty}, filterArgs...)...).
 		Load(&v)
 
 	if err != nil {
-		return []domain.Video{}, err
+		return []domain.Video{}, errors.WithStack(err)
+	}
+
+	var props []videoProperty
+
+	_, err = session.
+		SelectBySql(`
+SELECT
+  p.IBLOCK_ELEMENT_ID element_id,
+  bip.CODE code,
+  p.ID id,
+  p.VALUE value
+FROM b_iblock_property bip
+  JOIN b_iblock_element_property AS p
+    ON p.IBLOCK_PROPERTY_ID = bip.ID
+WHERE bip.IBLOCK_ID IN ? AND bip.CODE IN ?`+filter,
+			append([]interface{}{iblockIDs, s.codes}, filterArgs...)...).
+		Load(&props)
+
+	if err != nil {
+		return []domain.Video{}, errors.WithStack(err)
 	}
 
+	fillProps(v, props, s.codes)
+
 	return v, nil
 }
 
+// elementFilter returns a condition on elements of properties selected by f and its arguments,
+// the condition is empty if f is empty
+func elementFilter(f domain.VideoFilter) (string, []interface{}) {
+	var filter strings.Builder
+	var args []interface{}
+
+	if len(f.IDs) > 0 {
+		filter.WriteString(" AND p.IBLOCK_ELEMENT_ID IN ?")
+		args = append(args, f.IDs)
+	}
+
+	if f.FromID > 0 {
+		filter.WriteString(" AND p.IBLOCK_ELEMENT_ID >= ?")
+		args = append(args, f.FromID)
+	}
+
+	if f.ToID > 0 {
+		filter.WriteString(" AND p.IBLOCK_ELEMENT_ID <= ?")
+		args = append(args, f.ToID)
+	}
+
+	if !f.Since.IsZero() {
+		filter.WriteString(" AND p.IBLOCK_ELEMENT_ID IN (SELECT ID FROM b_iblock_element WHERE TIMESTAMP_X >= ?)")
+		args = append(args, f.Since)
+	}
+
+	return filter.String(), args
+}
+
+// fillProps sets properties props to videos v, every video gets a property for every code
+func fillProps(v []domain.Video, props []videoProperty, codes []string) {
+	byElement := make(map[int64][]videoProperty, len(v))
+	for _, p := range props {
+		byElement[p.ElementID] = append(byElement[p.ElementID], p)
+	}
+
+	for i := range v {
+		v[i].Props = make(map[string]*domain.Property, len(codes))
+		for _, code := range codes {
+			v[i].Props[code] = &domain.Property{}
+		}
+
+		for _, p := range byElement[v[i].ID] {
+			v[i].Props[p.Code] = &domain.Property{ID: p.ID, Value: p.Value}
+		}
+	}
+}
+
 // UpdatePropertyByID update a property with b_iblock_element_property = qualityID
 func (s *Storage) UpdatePropertyByID(id int64, value string) error {
 	_, err := s.db.NewSession(nil).
@@ -97,14 +193,18 @@ func (s *Storage) UpdatePropertyByID(id int64, value string) error {
 	return nil
 }
 
-// InsertProperty create a new property with b_iblock_element_property = qualityID if it isn't exists
-func (s *Storage) InsertProperty(elementID int64, propertyID int64, value string) error {
+// InsertProperty create a new property with b_iblock_element_property = qualityID if it isn't exists,
+// returns id of the new row
+func (s *Storage) InsertProperty(elementID int64, propertyID int64, value string) (int64, error) {
 	var maxID int64
 
+	s.insertMu.Lock()
+	defer s.insertMu.Unlock()
+
 	session := s.db.NewSession(nil)
 	_, err := session.Select("MAX(ID)").From("b_iblock_element_property").Load(&maxID)
 	if err != nil {
-		return errors.WithStack(err)
+		return 0, errors.WithStack(err)
 	}
 
 	maxID++
@@ -119,60 +219,193 @@ func (s *Storage) InsertProperty(elementID int64, propertyID int64, value string
 		Values(maxID, propertyID, elementID, value).
 		Exec()
 
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+
+	return maxID, nil
+}
+
+// SetLink updates the property with code of video v or inserts it if it isn't exists
+func (s *Storage) SetLink(v *domain.Video, code, link string) error {
+	pIDs, err := s.PropertyIDs(v.IBlockID)
+	if err != nil {
+		return err
+	}
+
+	v.SetLink(code, link)
+
+	p := v.Props[code]
+	if p.ID.Valid {
+		return s.UpdatePropertyByID(p.ID.Int64, link)
+	}
+
+	id, err := s.InsertProperty(v.ID, pIDs[code], link)
+	if err != nil {
+		return err
+	}
+
+	p.ID = dbr.NewNullInt64(id)
+
+	return nil
+}
+
+// ReplaceLink updates the property with code of video v to link if it still contains old
+func (s *Storage) ReplaceLink(v *domain.Video, code, old, link string) error {
+	p, ok := v.Props[code]
+	if !ok || !p.ID.Valid {
+		return errors.WithStack(domain.ErrLinkChanged)
+	}
+
+	res, err := s.db.NewSession(nil).
+		Update("b_iblock_element_property").
+		Set("VALUE", link).
+		Where(dbr.And(dbr.Eq("ID", p.ID.Int64), dbr.Eq("VALUE", old))).
+		Exec()
+
 	if err != nil {
 		return errors.WithStack(err)
 	}
 
+	if n, err := res.RowsAffected(); err != nil {
+		return errors.WithStack(err)
+	} else if n == 0 {
+		return errors.WithStack(domain.ErrLinkChanged)
+	}
+
+	v.SetLink(code, link)
+
 	return nil
 }
 
-// qualityIDs returns property ids for every video format (1080, 720, 480, 360, preview)
-// it used where we need to update or create value any video format
-func (s *Storage) qualityIDs() (*domain.QualityProperty, error) {
-	var qp domain.QualityProperty
+// ClearOriginal clears the link to the original of video v
+func (s *Storage) ClearOriginal(v *domain.Video) error {
+	return s.UpdatePropertyByID(v.IDOrig.Int64, "")
+}
 
-	session := s.db.NewSession(nil)
+// iblockIDs returns ids of configured iblocks
+func (s *Storage) iblockIDs() ([]int64, error) {
+	var rows []struct {
+		ID   int64  `db:"id"`
+		Type string `db:"type"`
+		Code string `db:"code"`
+	}
 
-	_, err := session.SelectBySql(
-		`
-SELECT
-bip1080.ID id_1080,
-bip720.ID id_720,
-bip480.ID id_480,
-bip360.ID id_360,
-bipPreview.ID id_preview
-FROM b_iblock
-  JOIN b_iblock_property bip360
-    ON bip360.IBLOCK_ID = b_iblock.ID AND bip360.CODE = 'VIDEO_LINK_360p'
-  JOIN b_iblock_property bip480
-    ON bip480.IBLOCK_ID = b_iblock.ID AND bip480.CODE = 'VIDEO_LINK_480p'
-  JOIN b_iblock_property bip720
-    ON bip720.IBLOCK_ID = b_iblock.ID AND bip720.CODE = 'VIDEO_LINK_720p'
-  JOIN b_iblock_property bip1080
-    ON bip1080.IBLOCK_ID = b_iblock.ID AND bip1080.CODE = 'VIDEO_LINK_1080p'
-  JOIN b_iblock_property bipPreview
-    ON bipPreview.IBLOCK_ID = b_iblock.ID and bipPreview.CODE = 'VIDEO_LINK_PREVIEW'
-WHERE b_iblock.CODE = 'lessons' AND b_iblock.IBLOCK_TYPE_ID = 'content'
-`,
-	).Load(&qp)
+	codes := make([]string, 0, len(s.bitrix.IBlocks))
+	for _, b := range s.bitrix.IBlocks {
+		codes = append(codes, b.Code)
+	}
+
+	_, err := s.db.NewSession(nil).
+		Select("ID id", "IBLOCK_TYPE_ID type", "CODE code").
+		From("b_iblock").
+		Where(dbr.Eq("CODE", codes)).
+		Load(&rows)
 
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
 
-	return &qp, nil
+	ids := make([]int64, 0, len(s.bitrix.IBlocks))
+
+	for _, b := range s.bitrix.IBlocks {
+		found := false
+
+		for _, r := range rows {
+			if r.Type == b.Type && r.Code == b.Code {
+				ids = append(ids, r.ID)
+				found = true
+			}
+		}
+
+		if !found {
+			return nil, errors.Errorf("iblock %s is not found", b)
+		}
+	}
+
+	return ids, nil
 }
 
-// QualityIDs returns property ids from cache or get it from db
-func (s *Storage) QualityIDs() (*domain.QualityProperty, error) {
-	if s.qIDs != nil {
-		return s.qIDs, nil
+// IBlockIDs returns ids of configured iblocks from cache or get it from db
+func (s *Storage) IBlockIDs() ([]int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.ibIDs != nil {
+		return s.ibIDs, nil
 	}
 
-	qp, err := s.qualityIDs()
+	ids, err := s.iblockIDs()
 	if err != nil {
 		return nil, err
 	}
 
-	return qp, nil
+	s.ibIDs = ids
+
+	return ids, nil
+}
+
+// propertyIDs returns property ids for every rendition property code by iblock id
+// it used where we need to update or create value any video format
+func (s *Storage) propertyIDs() (map[int64]domain.PropertyIDs, error) {
+	var rows []struct {
+		IBlockID int64  `db:"iblock_id"`
+		Code     string `db:"code"`
+		ID       int64  `db:"id"`
+	}
+
+	_, err := s.db.NewSession(nil).
+		Select("IBLOCK_ID iblock_id", "CODE code", "ID id").
+		From("b_iblock_property").
+		Where(dbr.And(dbr.Eq("IBLOCK_ID", s.ibIDs), dbr.Eq("CODE", s.codes))).
+		Load(&rows)
+
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	ids := make(map[int64]domain.PropertyIDs, len(s.ibIDs))
+	for _, id := range s.ibIDs {
+		ids[id] = make(domain.PropertyIDs, len(s.codes))
+	}
+
+	for _, r := range rows {
+		ids[r.IBlockID][r.Code] = r.ID
+	}
+
+	for i, id := range s.ibIDs {
+		for _, code := range s.codes {
+			if _, ok := ids[id][code]; !ok {
+				return nil, errors.Errorf("property %s is not found in iblock %s", code, s.bitrix.IBlocks[i])
+			}
+		}
+	}
+
+	return ids, nil
+}
+
+// PropertyIDs returns property ids of iblock from cache or get it from db
+func (s *Storage) PropertyIDs(iblockID int64) (domain.PropertyIDs, error) {
+	if _, err := s.IBlockIDs(); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.pIDs == nil {
+		ids, err := s.propertyIDs()
+		if err != nil {
+			return nil, err
+		}
+
+		s.pIDs = ids
+	}
+
+	pIDs, ok := s.pIDs[iblockID]
+	if !ok {
+		return nil, errors.Errorf("iblock %d is not configured", iblockID)
+	}
+
+	return pIDs, nil
 }
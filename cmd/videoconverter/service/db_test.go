@@ -0,0 +1,60 @@
+package service
+
+import (
+	"reflect"
+	"testing"
+	"time"
+	"videoconverter/domain"
+)
+
+func TestElementFilter(t *testing.T) {
+	since := time.Date(2026, 10, 1, 12, 0, 0, 0, time.Local)
+
+	tests := []struct {
+		name     string
+		f        domain.VideoFilter
+		wantCond string
+		wantArgs []interface{}
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name:     "ids",
+			f:        domain.VideoFilter{IDs: []int64{42, 43}},
+			wantCond: " AND p.IBLOCK_ELEMENT_ID IN ?",
+			wantArgs: []interface{}{[]int64{42, 43}},
+		},
+		{
+			name:     "id range",
+			f:        domain.VideoFilter{FromID: 100, ToID: 200},
+			wantCond: " AND p.IBLOCK_ELEMENT_ID >= ? AND p.IBLOCK_ELEMENT_ID <= ?",
+			wantArgs: []interface{}{int64(100), int64(200)},
+		},
+		{
+			name:     "open id range",
+			f:        domain.VideoFilter{ToID: 200},
+			wantCond: " AND p.IBLOCK_ELEMENT_ID <= ?",
+			wantArgs: []interface{}{int64(200)},
+		},
+		{
+			name:     "since",
+			f:        domain.VideoFilter{FromID: 100, Since: since},
+			wantCond: " AND p.IBLOCK_ELEMENT_ID >= ? AND p.IBLOCK_ELEMENT_ID IN (SELECT ID FROM b_iblock_element WHERE TIMESTAMP_X >= ?)",
+			wantArgs: []interface{}{int64(100), since},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cond, args := elementFilter(tt.f)
+			if cond != tt.wantCond {
+				t.Errorf("elementFilter() condition = %q, want %q", cond, tt.wantCond)
+			}
+
+			if !reflect.DeepEqual(args, tt.wantArgs) {
+				t.Errorf("elementFilter() args = %v, want %v", args, tt.wantArgs)
+			}
+		})
+	}
+}
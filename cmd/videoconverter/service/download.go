@@ -0,0 +1,172 @@
+package service
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"videoconverter/domain"
+)
+
+var reMD5 = regexp.MustCompile(`^[0-9a-fA-F]{32}$`)
+
+// download downloads a file from url u into file f.
+// If f already has a part of the file downloaded earlier, only the rest is requested
+// with a Range header, the download is restarted if the remote file was changed.
+// sign is called for the ready request, e.g. to add authorization, it can be nil.
+func download(ctx context.Context, client *http.Client, u string, f *os.File, sign func(*http.Request) error, l domain.Logger) error {
+	l = domain.LoggerFrom(ctx, l)
+
+	info, err := f.Stat()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	offset := info.Size()
+	metaPath := domain.DownloadMetaPath(f.Name())
+
+	etag, err := ioutil.ReadFile(metaPath)
+	if err != nil || len(etag) == 0 {
+		// without an etag we can't check that the local part belongs to the same remote file
+		offset = 0
+	}
+
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	req = req.WithContext(ctx)
+
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		req.Header.Set("If-Range", string(etag))
+	}
+
+	if sign != nil {
+		if err := sign(req); err != nil {
+			return err
+		}
+	}
+
+	r, err := client.Do(req)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	defer r.Body.Close()
+
+	var total int64
+
+	switch r.StatusCode {
+	case http.StatusOK:
+		offset = 0
+		total = r.ContentLength
+
+	case http.StatusPartialContent:
+		start, size, ok := parseContentRange(r.Header.Get("Content-Range"))
+		if !ok || start != offset {
+			return errors.Errorf("unexpected Content-Range %q for offset %d", r.Header.Get("Content-Range"), offset)
+		}
+
+		total = size
+
+	case http.StatusRequestedRangeNotSatisfiable:
+		// the local file is already complete if its size equals the remote one
+		_, size, ok := parseContentRange(r.Header.Get("Content-Range"))
+		if ok && size == offset {
+			l.Info("original is already downloaded", domain.Stage(domain.StageDownload), domain.F("file", f.Name()))
+
+			return verifyETag(f, string(etag))
+		}
+
+		if err := f.Truncate(0); err != nil {
+			return errors.WithStack(err)
+		}
+
+		return errors.WithStack(StatusError{r.StatusCode})
+
+	default:
+		return errors.WithStack(StatusError{r.StatusCode})
+	}
+
+	if offset == 0 {
+		if err := f.Truncate(0); err != nil {
+			return errors.WithStack(err)
+		}
+	} else {
+		l.Info("resuming download", domain.Stage(domain.StageDownload), domain.F("url", u), domain.F("offset", offset))
+	}
+
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return errors.WithStack(err)
+	}
+
+	etag = []byte(r.Header.Get("ETag"))
+	if err := ioutil.WriteFile(metaPath, etag, os.FileMode(0660)); err != nil {
+		return errors.WithStack(err)
+	}
+
+	n, err := io.Copy(f, r.Body)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if total >= 0 && offset+n < total {
+		return errors.WithStack(ErrNotFullWrite)
+	}
+
+	return verifyETag(f, string(etag))
+}
+
+// parseContentRange parses a Content-Range header like "bytes 100-199/200" or "bytes */200",
+// returns the first byte position and the full size of the file
+func parseContentRange(h string) (int64, int64, bool) {
+	var start, end, size int64
+
+	if _, err := fmt.Sscanf(h, "bytes %d-%d/%d", &start, &end, &size); err == nil {
+		return start, size, true
+	}
+
+	if _, err := fmt.Sscanf(h, "bytes */%d", &size); err == nil {
+		return -1, size, true
+	}
+
+	return 0, 0, false
+}
+
+// verifyETag compares a md5 checksum of file f with etag if the etag is a md5 hash,
+// other etags (weak, multipart) can't be checked. The file is truncated if it's corrupted,
+// so the next download starts from the beginning.
+func verifyETag(f *os.File, etag string) error {
+	etag = strings.Trim(etag, `"`)
+	if !reMD5.MatchString(etag) {
+		return nil
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return errors.WithStack(err)
+	}
+
+	h := md5.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return errors.WithStack(err)
+	}
+
+	if hex.EncodeToString(h.Sum(nil)) == strings.ToLower(etag) {
+		return nil
+	}
+
+	if err := f.Truncate(0); err != nil {
+		return errors.WithStack(err)
+	}
+
+	return errors.WithStack(ErrChecksum)
+}
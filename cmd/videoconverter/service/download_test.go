@@ -0,0 +1,27 @@
+package service
+
+import "testing"
+
+func TestParseContentRange(t *testing.T) {
+	tests := []struct {
+		header    string
+		wantStart int64
+		wantSize  int64
+		wantOK    bool
+	}{
+		{header: "bytes 100-199/200", wantStart: 100, wantSize: 200, wantOK: true},
+		{header: "bytes 0-0/1", wantStart: 0, wantSize: 1, wantOK: true},
+		{header: "bytes */200", wantStart: -1, wantSize: 200, wantOK: true},
+		{header: "bytes 100-199/*"},
+		{header: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.header, func(t *testing.T) {
+			start, size, ok := parseContentRange(tt.header)
+			if start != tt.wantStart || size != tt.wantSize || ok != tt.wantOK {
+				t.Errorf("parseContentRange() = %d, %d, %v, want %d, %d, %v", start, size, ok, tt.wantStart, tt.wantSize, tt.wantOK)
+			}
+		})
+	}
+}
@@ -4,10 +4,11 @@ import (
 	"context"
 	"fmt"
 	"github.com/pkg/errors"
-	"os/exec"
+	"os"
 	"path"
 	"strconv"
-	"videoconverter/bootstrap"
+	"strings"
+	"time"
 	"videoconverter/domain"
 )
 
@@ -20,91 +21,447 @@ func (e cmdError) Error() string {
 	return fmt.Sprintf("%v\n%s\n", e.err, e.out)
 }
 
+const (
+	// previewDuration is a duration of a preview cut from the beginning of a video
+	previewDuration = 3 * time.Minute
+	// hlsMaster is a file name of the HLS master playlist
+	hlsMaster = "master.m3u8"
+	// dashManifest is a file name of the DASH manifest
+	dashManifest = "manifest.mpd"
+)
+
 type VideoEncoder struct {
-	ctx       context.Context
 	ffmpeg    string
 	threadMax int
-	l         *bootstrap.Logger
+	// keyInterval is an interval of forced key frames in seconds in renditions of the main ladder,
+	// so they are segmented into HLS and DASH without re-encoding, 0 if packaging is disabled
+	keyInterval int
+	l           domain.Logger
 }
 
-func NewEncoder(ctx context.Context, ffmpeg string, threadMax int, l *bootstrap.Logger) *VideoEncoder {
+func NewEncoder(ffmpeg string, threadMax int, keyInterval int, l domain.Logger) *VideoEncoder {
 	return &VideoEncoder{
-		ctx:       ctx,
-		ffmpeg:    ffmpeg,
-		threadMax: threadMax,
-		l:         l,
+		ffmpeg:      ffmpeg,
+		threadMax:   threadMax,
+		keyInterval: keyInterval,
+		l:           l,
 	}
 }
 
-// Convert a video from src to dst with q quality, return path to new video.
-func (e *VideoEncoder) Convert(tmp string, filePath string, quality domain.VQ) (string, error) {
-	e.l.D(fmt.Sprintf("Начинаю конвертировать файл %s в качество %d", filePath, quality))
+// Convert a video from src to dst with rendition r, return path to new video.
+func (e *VideoEncoder) Convert(ctx context.Context, tmp string, filePath string, r domain.Rendition) (string, error) {
+	l := domain.LoggerFrom(ctx, e.l).With(domain.Stage(domain.StageEncode), domain.F("file", filePath))
+	l.Debug("encoding started")
+	start := time.Now()
+
+	outVideo := outputPath(tmp, filePath, r)
 
+	args := []string{"-y", "-i", filePath}
+	args = append(args, e.videoArgs(r)...)
+	args = append(args, outVideo)
+
+	if err := e.run(ctx, 0, args...); err != nil {
+		return "", err
+	}
+
+	l.Info("encoding finished", domain.DurationMs(time.Since(start)))
+
+	return outVideo, nil
+}
+
+// outputPath returns a path of a file of rendition r made from the original filePath in the dir tmp,
+// its extension is set by the container of r
+func outputPath(tmp, filePath string, r domain.Rendition) string {
 	_, fName := path.Split(filePath)
-	outVideo := fmt.Sprintf("%s/v-%d-%s", tmp, quality, fName)
 
-	cmd := exec.CommandContext(e.ctx,
-		e.ffmpeg,
-		"-y",
-		"-i",
-		filePath,
-		"-profile:v",
-		"baseline",
-		"-movflags",
-		"+faststart",
-		"-vcodec",
-		"libx264",
-		"-crf",
-		"28",
-		"-preset",
-		"faster",
-		"-acodec",
-		"aac",
+	return fmt.Sprintf("%s/v-%s-%s%s", tmp, r.Name, strings.TrimSuffix(fName, path.Ext(fName)), r.Ext())
+}
+
+// muxerArgs returns ffmpeg arguments of the container of rendition r
+func muxerArgs(r domain.Rendition) []string {
+	if r.Container == domain.ContainerWebM {
+		return nil
+	}
+
+	return []string{"-movflags", "+faststart"}
+}
+
+// videoArgs returns ffmpeg output arguments for rendition r
+func (e *VideoEncoder) videoArgs(r domain.Rendition) []string {
+	args := muxerArgs(r)
+	args = append(args, codecArgs(r.Encoding, "v")...)
+	args = append(args, e.keyFrameArgs(r)...)
+	args = append(args, audioArgs(r.Encoding, "a")...)
+
+	return append(args,
 		"-threads",
 		strconv.Itoa(e.threadMax),
 		"-filter:v",
-		fmt.Sprintf("scale=trunc(oh*a/2)*2:%d", quality),
-		outVideo,
+		scaleFilter(r),
 	)
+}
 
-	out, err := cmd.CombinedOutput()
-	if err != nil {
-		return "", errors.WithStack(cmdError{out, err})
+// codecArgs returns ffmpeg video codec arguments of encoding settings enc
+// for output streams with specifier spec, e.g. "v" or "v:0"
+func codecArgs(enc domain.Encoding, spec string) []string {
+	args := []string{"-c:" + spec, enc.Codec}
+
+	if enc.Profile != "" {
+		args = append(args, "-profile:"+spec, enc.Profile)
+	}
+
+	switch {
+	case enc.Bitrate != "":
+		args = append(args, "-b:"+spec, enc.Bitrate)
+	case enc.Codec == "libvpx-vp9" || enc.Codec == "libaom-av1":
+		// these encoders use CRF as a constant quality only with the zero bitrate
+		args = append(args, "-crf:"+spec, strconv.Itoa(enc.CRF), "-b:"+spec, "0")
+	default:
+		args = append(args, "-crf:"+spec, strconv.Itoa(enc.CRF))
 	}
 
-	e.l.D(fmt.Sprintf("Успешно сконвертировали файл %s в качество %d", filePath, quality))
+	// Apple players play HEVC in mp4 only with the hvc1 tag
+	if enc.Codec == "libx265" && enc.Container == domain.ContainerMP4 {
+		args = append(args, "-tag:"+spec, "hvc1")
+	}
 
-	return outVideo, nil
+	if enc.MaxRate != "" {
+		args = append(args, "-maxrate:"+spec, enc.MaxRate, "-bufsize:"+spec, enc.BufSize)
+	}
+
+	switch {
+	case enc.Preset == "":
+	case enc.Codec == "libaom-av1":
+		// libaom has no presets, the speed is set by cpu-used and rows of tiles are encoded in parallel
+		args = append(args, "-cpu-used:"+spec, enc.Preset, "-row-mt:"+spec, "1")
+	default:
+		args = append(args, "-preset:"+spec, enc.Preset)
+	}
+
+	if enc.GOP > 0 {
+		args = append(args, "-g:"+spec, strconv.Itoa(enc.GOP))
+	}
+
+	return args
+}
+
+// audioArgs returns ffmpeg audio codec arguments of encoding settings enc
+// for output streams with specifier spec, e.g. "a" or "a:0"
+func audioArgs(enc domain.Encoding, spec string) []string {
+	args := []string{"-c:" + spec, enc.AudioCodec}
+
+	if enc.AudioBitrate != "" {
+		args = append(args, "-b:"+spec, enc.AudioBitrate)
+	}
+
+	if enc.AudioChannels > 0 {
+		args = append(args, "-ac:"+spec, strconv.Itoa(enc.AudioChannels))
+	}
+
+	if enc.AudioSampleRate > 0 {
+		args = append(args, "-ar:"+spec, strconv.Itoa(enc.AudioSampleRate))
+	}
+
+	return args
+}
+
+// formatDuration formats d as ffmpeg time, e.g. 00:03:00
+func formatDuration(d time.Duration) string {
+	d = d.Round(time.Second)
+
+	return fmt.Sprintf("%02d:%02d:%02d", int(d.Hours()), int(d.Minutes())%60, int(d.Seconds())%60)
+}
+
+// keyFrameArgs returns ffmpeg arguments which put key frames of rendition r at boundaries of segments,
+// only renditions of the main ladder are packaged
+func (e *VideoEncoder) keyFrameArgs(r domain.Rendition) []string {
+	if e.keyInterval <= 0 || r.Preview || r.Variant != "" {
+		return nil
+	}
+
+	return []string{
+		"-sc_threshold",
+		"0",
+		"-force_key_frames",
+		fmt.Sprintf("expr:gte(t,n_forced*%d)", e.keyInterval),
+	}
+}
+
+// scaleFilter returns a filter which scales a video to the height of rendition r
+func scaleFilter(r domain.Rendition) string {
+	return fmt.Sprintf("scale=trunc(oh*a/2)*2:%d", r.Height)
 }
 
-func (e *VideoEncoder) CreatePreview(tmp, filePath string) (string, error) {
-	e.l.D(fmt.Sprintf("Создается превью файла %s", filePath))
+func (e *VideoEncoder) CreatePreview(ctx context.Context, tmp, filePath string) (string, error) {
+	l := domain.LoggerFrom(ctx, e.l).With(domain.Stage(domain.StageEncode), domain.F("file", filePath))
+	l.Debug("preview started")
+	start := time.Now()
 
 	_, fName := path.Split(filePath)
 	outVideo := fmt.Sprintf("%s/v-preview-%s", tmp, fName)
 
-	cmd := exec.CommandContext(e.ctx,
-		e.ffmpeg,
+	err := e.run(ctx, previewDuration,
 		"-y",
 		"-threads",
 		strconv.Itoa(e.threadMax),
 		"-ss",
 		"00:00:00",
 		"-to",
-		"00:03:00",
+		formatDuration(previewDuration),
 		"-i",
 		filePath,
 		"-c",
 		"copy",
 		outVideo,
 	)
-
-	out, err := cmd.CombinedOutput()
 	if err != nil {
-		return "", errors.WithStack(cmdError{out, err})
+		return "", err
 	}
 
-	e.l.D(fmt.Sprintf("Успешно создано превью для файла %s", filePath))
+	l.Info("preview finished", domain.DurationMs(time.Since(start)))
 
 	return outVideo, nil
 }
+
+// ConvertAll converts a video to all renditions rr in one ffmpeg run, the original is decoded once
+// and split between scalers of every rendition. Returns paths to new videos by rendition names.
+func (e *VideoEncoder) ConvertAll(ctx context.Context, tmp, filePath string, rr []domain.Rendition) (map[string]string, error) {
+	l := domain.LoggerFrom(ctx, e.l).With(domain.Stage(domain.StageEncode), domain.F("file", filePath))
+	l.Debug("single pass encoding started", domain.F("renditions", len(rr)))
+	start := time.Now()
+
+	var scaled []domain.Rendition
+	for _, r := range rr {
+		if !r.Preview {
+			scaled = append(scaled, r)
+		}
+	}
+
+	args := []string{"-y", "-i", filePath}
+
+	if len(scaled) > 0 {
+		args = append(args, "-filter_complex", splitFilter(scaled))
+	}
+
+	files := make(map[string]string, len(rr))
+	threads := strconv.Itoa(outputThreads(e.threadMax, len(scaled)))
+	i := 0
+
+	for _, r := range rr {
+		outVideo := outputPath(tmp, filePath, r)
+		files[r.Name] = outVideo
+
+		if r.Preview {
+			args = append(args,
+				"-map",
+				"0:v:0",
+				"-map",
+				"0:a:0?",
+				"-t",
+				formatDuration(previewDuration),
+				"-c",
+				"copy",
+				outVideo,
+			)
+
+			continue
+		}
+
+		args = append(args, "-map", fmt.Sprintf("[v%d]", i), "-map", "0:a:0?")
+		args = append(args, muxerArgs(r)...)
+		args = append(args, codecArgs(r.Encoding, "v")...)
+		args = append(args, e.keyFrameArgs(r)...)
+		args = append(args, audioArgs(r.Encoding, "a")...)
+		args = append(args,
+			"-threads",
+			threads,
+			outVideo,
+		)
+
+		i++
+	}
+
+	if err := e.run(ctx, 0, args...); err != nil {
+		for _, f := range files {
+			os.Remove(f)
+		}
+
+		return nil, err
+	}
+
+	l.Info("single pass encoding finished", domain.DurationMs(time.Since(start)))
+
+	return files, nil
+}
+
+// outputThreads divides threadMax threads of one ffmpeg process between n encoded outputs,
+// every output gets at least one thread
+func outputThreads(threadMax, n int) int {
+	if n < 1 {
+		return threadMax
+	}
+
+	if threadMax <= n {
+		return 1
+	}
+
+	return threadMax / n
+}
+
+// splitFilter returns a filter graph which decodes the first video stream once
+// and scales it to every rendition of rr, outputs are labeled [v0], [v1]...
+func splitFilter(rr []domain.Rendition) string {
+	var filter strings.Builder
+
+	fmt.Fprintf(&filter, "[0:v]split=%d", len(rr))
+	for i := range rr {
+		fmt.Fprintf(&filter, "[s%d]", i)
+	}
+	for i, r := range rr {
+		fmt.Fprintf(&filter, ";[s%d]%s[v%d]", i, scaleFilter(r), i)
+	}
+
+	return filter.String()
+}
+
+// Package segments encoded renditions rr of a video into one directory with HLS and/or DASH manifests,
+// files are paths to the renditions by their names. Streams are copied without re-encoding, so the renditions
+// must have key frames at boundaries of segments. If both formats are enabled they share the same fMP4 segments.
+// Streams have no audio if audio isn't set.
+func (e *VideoEncoder) Package(ctx context.Context, tmp, filePath string, rr []domain.Rendition, files map[string]string, p domain.Packaging, audio bool) (*domain.Package, error) {
+	l := domain.LoggerFrom(ctx, e.l).With(domain.Stage(domain.StagePackage), domain.F("file", filePath))
+	l.Debug("packaging started", domain.F("hls", p.HLS), domain.F("dash", p.DASH))
+	start := time.Now()
+
+	args := []string{"-y"}
+
+	for _, r := range rr {
+		if files[r.Name] == "" {
+			return nil, errors.Errorf("rendition %s isn't encoded", r.Name)
+		}
+
+		args = append(args, "-i", files[r.Name])
+	}
+
+	_, fName := path.Split(filePath)
+	dir := fmt.Sprintf("%s/stream-%s", tmp, strings.TrimSuffix(fName, path.Ext(fName)))
+
+	if err := os.RemoveAll(dir); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	if err := os.Mkdir(dir, os.FileMode(0766)); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	for i := range rr {
+		args = append(args, "-map", fmt.Sprintf("%d:v:0", i))
+	}
+
+	args = append(args, "-c", "copy")
+
+	pkg := domain.Package{Dir: dir}
+
+	if p.DASH {
+		args = dashArgs(args, dir, p, audio)
+		pkg.DASHManifest = dashManifest
+	} else {
+		var err error
+
+		args, err = hlsArgs(args, dir, rr, p, audio)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if p.HLS {
+		pkg.HLSMaster = hlsMaster
+	}
+
+	if err := e.run(ctx, 0, args...); err != nil {
+		os.RemoveAll(dir)
+
+		return nil, err
+	}
+
+	l.Info("packaging finished", domain.DurationMs(time.Since(start)))
+
+	return &pkg, nil
+}
+
+// hlsArgs appends HLS muxer arguments to args, every variant stream gets its own subdirectory in dir
+// and the audio stream of its input if audio is set
+func hlsArgs(args []string, dir string, rr []domain.Rendition, p domain.Packaging, audio bool) ([]string, error) {
+	streams := make([]string, 0, len(rr))
+
+	for i, r := range rr {
+		if err := os.Mkdir(dir+"/"+r.Name, os.FileMode(0766)); err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		if !audio {
+			streams = append(streams, fmt.Sprintf("v:%d,name:%s", i, r.Name))
+			continue
+		}
+
+		args = append(args, "-map", fmt.Sprintf("%d:a:0", i))
+		streams = append(streams, fmt.Sprintf("v:%d,a:%d,name:%s", i, i, r.Name))
+	}
+
+	segment := "segment_%03d.ts"
+	if p.SegmentType == "fmp4" {
+		segment = "segment_%03d.m4s"
+	}
+
+	return append(args,
+		"-f",
+		"hls",
+		"-hls_time",
+		strconv.Itoa(p.SegmentTime),
+		"-hls_playlist_type",
+		"vod",
+		"-hls_segment_type",
+		p.SegmentType,
+		"-hls_segment_filename",
+		dir+"/%v/"+segment,
+		"-master_pl_name",
+		hlsMaster,
+		"-var_stream_map",
+		strings.Join(streams, " "),
+		dir+"/%v/index.m3u8",
+	), nil
+}
+
+// dashArgs appends DASH muxer arguments to args, all representations share the audio stream of the first input
+// if audio is set, HLS playlists are written from the same segments if p.HLS is set
+func dashArgs(args []string, dir string, p domain.Packaging, audio bool) []string {
+	sets := "id=0,streams=v"
+
+	if audio {
+		args = append(args, "-map", "0:a:0")
+		sets += " id=1,streams=a"
+	}
+
+	args = append(args,
+		"-f",
+		"dash",
+		"-seg_duration",
+		strconv.Itoa(p.SegmentTime),
+		"-use_template",
+		"1",
+		"-use_timeline",
+		"1",
+		"-adaptation_sets",
+		sets,
+		"-init_seg_name",
+		"init-$RepresentationID$.m4s",
+		"-media_seg_name",
+		"chunk-$RepresentationID$-$Number%05d$.m4s",
+	)
+
+	if p.HLS {
+		args = append(args, "-hls_playlist", "1")
+	}
+
+	return append(args, dir+"/"+dashManifest)
+}
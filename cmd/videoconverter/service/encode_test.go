@@ -0,0 +1,204 @@
+package service
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"videoconverter/domain"
+)
+
+func TestCodecArgs(t *testing.T) {
+	tests := []struct {
+		name string
+		enc  domain.Encoding
+		spec string
+		want []string
+	}{
+		{
+			name: "crf",
+			enc:  domain.Encoding{Codec: "libx264", Profile: "baseline", CRF: 28, Preset: "faster"},
+			spec: "v",
+			want: []string{"-c:v", "libx264", "-profile:v", "baseline", "-crf:v", "28", "-preset:v", "faster"},
+		},
+		{
+			name: "bitrate instead of crf",
+			enc:  domain.Encoding{Codec: "libx264", Bitrate: "2500k", CRF: 23, MaxRate: "3000k", BufSize: "6000k", GOP: 50},
+			spec: "v:1",
+			want: []string{"-c:v:1", "libx264", "-b:v:1", "2500k", "-maxrate:v:1", "3000k", "-bufsize:v:1", "6000k", "-g:v:1", "50"},
+		},
+		{
+			name: "vp9 constant quality",
+			enc:  domain.Encoding{Codec: "libvpx-vp9", Container: domain.ContainerWebM, CRF: 33},
+			spec: "v",
+			want: []string{"-c:v", "libvpx-vp9", "-crf:v", "33", "-b:v", "0"},
+		},
+		{
+			name: "av1 constant quality",
+			enc:  domain.Encoding{Codec: "libaom-av1", CRF: 35},
+			spec: "v",
+			want: []string{"-c:v", "libaom-av1", "-crf:v", "35", "-b:v", "0"},
+		},
+		{
+			name: "av1 speed",
+			enc:  domain.Encoding{Codec: "libaom-av1", CRF: 35, Preset: "6"},
+			spec: "v:0",
+			want: []string{"-c:v:0", "libaom-av1", "-crf:v:0", "35", "-b:v:0", "0", "-cpu-used:v:0", "6", "-row-mt:v:0", "1"},
+		},
+		{
+			name: "hevc in mp4",
+			enc:  domain.Encoding{Codec: "libx265", Container: domain.ContainerMP4, CRF: 28},
+			spec: "v",
+			want: []string{"-c:v", "libx265", "-crf:v", "28", "-tag:v", "hvc1"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := codecArgs(tt.enc, tt.spec); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("codecArgs() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAudioArgs(t *testing.T) {
+	tests := []struct {
+		name string
+		enc  domain.Encoding
+		spec string
+		want []string
+	}{
+		{
+			name: "codec only",
+			enc:  domain.Encoding{AudioCodec: "aac"},
+			spec: "a",
+			want: []string{"-c:a", "aac"},
+		},
+		{
+			name: "all settings",
+			enc:  domain.Encoding{AudioCodec: "libopus", AudioBitrate: "128k", AudioChannels: 2, AudioSampleRate: 48000},
+			spec: "a:0",
+			want: []string{"-c:a:0", "libopus", "-b:a:0", "128k", "-ac:a:0", "2", "-ar:a:0", "48000"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := audioArgs(tt.enc, tt.spec); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("audioArgs() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHLSArgs(t *testing.T) {
+	rr := []domain.Rendition{
+		{Name: "720", Encoding: domain.Encoding{AudioCodec: "aac"}},
+		{Name: "360", Encoding: domain.Encoding{AudioCodec: "aac"}},
+	}
+	p := domain.Packaging{HLS: true, SegmentTime: 6, SegmentType: "mpegts"}
+
+	tests := []struct {
+		name      string
+		audio     bool
+		wantMaps  int
+		streamMap string
+	}{
+		{name: "with audio", audio: true, wantMaps: 2, streamMap: "v:0,a:0,name:720 v:1,a:1,name:360"},
+		{name: "without audio", audio: false, wantMaps: 0, streamMap: "v:0,name:720 v:1,name:360"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args, err := hlsArgs(nil, t.TempDir(), rr, p, tt.audio)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := audioMaps(args); got != tt.wantMaps {
+				t.Errorf("hlsArgs() maps audio %d times, want %d", got, tt.wantMaps)
+			}
+
+			if got := value(args, "-var_stream_map"); got != tt.streamMap {
+				t.Errorf("hlsArgs() var_stream_map = %q, want %q", got, tt.streamMap)
+			}
+		})
+	}
+}
+
+func TestDASHArgs(t *testing.T) {
+	p := domain.Packaging{DASH: true, SegmentTime: 6}
+
+	tests := []struct {
+		name     string
+		audio    bool
+		wantMaps int
+		sets     string
+	}{
+		{name: "with audio", audio: true, wantMaps: 1, sets: "id=0,streams=v id=1,streams=a"},
+		{name: "without audio", audio: false, wantMaps: 0, sets: "id=0,streams=v"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := dashArgs(nil, "stream", p, tt.audio)
+
+			if got := audioMaps(args); got != tt.wantMaps {
+				t.Errorf("dashArgs() maps audio %d times, want %d", got, tt.wantMaps)
+			}
+
+			if got := value(args, "-adaptation_sets"); got != tt.sets {
+				t.Errorf("dashArgs() adaptation_sets = %q, want %q", got, tt.sets)
+			}
+
+			if got := args[len(args)-1]; !strings.HasSuffix(got, dashManifest) {
+				t.Errorf("dashArgs() output = %q, want the manifest", got)
+			}
+		})
+	}
+}
+
+func TestOutputThreads(t *testing.T) {
+	tests := []struct {
+		name      string
+		threadMax int
+		n         int
+		want      int
+	}{
+		{name: "one output", threadMax: 4, n: 1, want: 4},
+		{name: "divided", threadMax: 8, n: 3, want: 2},
+		{name: "more outputs than threads", threadMax: 2, n: 4, want: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := outputThreads(tt.threadMax, tt.n); got != tt.want {
+				t.Errorf("outputThreads() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+// audioMaps returns a number of audio streams mapped in args
+func audioMaps(args []string) int {
+	var n int
+
+	for i := 1; i < len(args); i++ {
+		if args[i-1] == "-map" && strings.HasSuffix(args[i], ":a:0") {
+			n++
+		}
+	}
+
+	return n
+}
+
+// value returns an argument which follows the option name in args
+func value(args []string, name string) string {
+	for i := 0; i < len(args)-1; i++ {
+		if args[i] == name {
+			return args[i+1]
+		}
+	}
+
+	return ""
+}
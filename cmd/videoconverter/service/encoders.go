@@ -0,0 +1,73 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"github.com/pkg/errors"
+	"os/exec"
+	"sort"
+	"strings"
+	"videoconverter/domain"
+)
+
+// CheckEncoders checks that ffmpeg is built with video and audio encoders of renditions rr,
+// so a config with an unavailable encoder is rejected at startup instead of failing every video
+func (e *VideoEncoder) CheckEncoders(ctx context.Context, rr []domain.Rendition) error {
+	out, err := exec.CommandContext(ctx, e.ffmpeg, "-hide_banner", "-encoders").CombinedOutput()
+	if err != nil {
+		return errors.WithStack(cmdError{out, err})
+	}
+
+	missing := missingEncoders(parseEncoders(out), rr)
+	if len(missing) > 0 {
+		return errors.Errorf("ffmpeg has no encoders %s", strings.Join(missing, ", "))
+	}
+
+	return nil
+}
+
+// parseEncoders parses names of encoders listed by ffmpeg -encoders
+func parseEncoders(out []byte) map[string]bool {
+	encoders := make(map[string]bool)
+
+	var isList bool
+
+	s := bufio.NewScanner(bytes.NewReader(out))
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+
+		switch {
+		case len(fields) == 0:
+			continue
+		case strings.HasPrefix(fields[0], "---"):
+			isList = true
+		case isList && len(fields) > 1:
+			encoders[fields[1]] = true
+		}
+	}
+
+	return encoders
+}
+
+// missingEncoders returns sorted names of video and audio encoders of renditions rr which aren't in encoders
+func missingEncoders(encoders map[string]bool, rr []domain.Rendition) []string {
+	seen := make(map[string]bool)
+
+	var missing []string
+
+	for _, r := range rr {
+		for _, name := range []string{r.Codec, r.AudioCodec} {
+			if name == "" || name == "copy" || encoders[name] || seen[name] {
+				continue
+			}
+
+			seen[name] = true
+			missing = append(missing, name)
+		}
+	}
+
+	sort.Strings(missing)
+
+	return missing
+}
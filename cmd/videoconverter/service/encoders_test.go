@@ -0,0 +1,63 @@
+package service
+
+import (
+	"reflect"
+	"testing"
+	"videoconverter/domain"
+)
+
+const encodersOut = `Encoders:
+ V..... = Video
+ A..... = Audio
+ S..... = Subtitle
+ .F.... = Frame-level multithreading
+ ------
+ V..... libx264              libx264 H.264 / AVC / MPEG-4 AVC / MPEG-4 part 10 (codec h264)
+ V..... libvpx-vp9           libvpx VP9 (codec vp9)
+ A..... aac                  AAC (Advanced Audio Coding)
+ A..... libopus              libopus Opus (codec opus)
+`
+
+func TestParseEncoders(t *testing.T) {
+	want := map[string]bool{"libx264": true, "libvpx-vp9": true, "aac": true, "libopus": true}
+
+	if got := parseEncoders([]byte(encodersOut)); !reflect.DeepEqual(got, want) {
+		t.Errorf("parseEncoders() = %v, want %v", got, want)
+	}
+}
+
+func TestMissingEncoders(t *testing.T) {
+	encoders := parseEncoders([]byte(encodersOut))
+
+	tests := []struct {
+		name string
+		rr   []domain.Rendition
+		want []string
+	}{
+		{
+			name: "all available",
+			rr: []domain.Rendition{
+				{Name: "720", Encoding: domain.Encoding{Codec: "libx264", AudioCodec: "aac"}},
+				{Name: "720-vp9", Encoding: domain.Encoding{Codec: "libvpx-vp9", AudioCodec: "libopus"}},
+				{Name: "preview", Preview: true},
+			},
+		},
+		{
+			name: "missing once and sorted",
+			rr: []domain.Rendition{
+				{Name: "1080-hevc", Encoding: domain.Encoding{Codec: "libx265", AudioCodec: "aac"}},
+				{Name: "1080-av1", Encoding: domain.Encoding{Codec: "libsvtav1", AudioCodec: "aac"}},
+				{Name: "720-hevc", Encoding: domain.Encoding{Codec: "libx265", AudioCodec: "copy"}},
+			},
+			want: []string{"libsvtav1", "libx265"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := missingEncoders(encoders, tt.rr); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("missingEncoders() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,136 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"videoconverter/bootstrap"
+	"videoconverter/domain"
+)
+
+// FileCloud describe a cloud in a local directory, links are made with a public url
+// of the directory, e.g. a local web server. It's useful for development without cloud credentials.
+type FileCloud struct {
+	dir       string
+	publicURL string
+
+	l domain.Logger
+}
+
+// NewFileCloud returns ready for use *FileCloud instance, the directory is created by the first upload
+func NewFileCloud(c bootstrap.FS, l domain.Logger) (*FileCloud, error) {
+	publicURL := c.PublicURL
+	if !strings.HasSuffix(publicURL, "/") {
+		publicURL += "/"
+	}
+
+	return &FileCloud{
+		dir:       c.Dir,
+		publicURL: publicURL,
+		l:         l,
+	}, nil
+}
+
+// DownloadFile copies a file with link u into file f,
+// links which don't belong to the directory are downloaded by http
+func (c *FileCloud) DownloadFile(ctx context.Context, u string, f *os.File) error {
+	p, err := c.Path(u)
+	if err != nil {
+		return download(ctx, http.DefaultClient, u, f, nil, c.l)
+	}
+
+	src, err := os.Open(c.file(p))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer src.Close()
+
+	if err := f.Truncate(0); err != nil {
+		return errors.WithStack(err)
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return errors.WithStack(err)
+	}
+
+	if _, err := io.Copy(f, src); err != nil {
+		return errors.WithStack(err)
+	}
+
+	return nil
+}
+
+// UploadFile copies a file into the directory with relative path,
+// the file is written under a temp name and renamed, so nobody sees a partial file
+func (c *FileCloud) UploadFile(ctx context.Context, path string, f *os.File) (string, error) {
+	dst := c.file(path)
+
+	if err := os.MkdirAll(filepath.Dir(dst), os.FileMode(0766)); err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(dst), ".upload-")
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, f); err != nil {
+		tmp.Close()
+		return "", errors.WithStack(err)
+	}
+
+	if err := tmp.Close(); err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	if err := os.Chmod(tmp.Name(), os.FileMode(0664)); err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	if err := os.Rename(tmp.Name(), dst); err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	return c.publicURL + path, nil
+}
+
+// Delete deletes a file with relative path from the directory
+func (c *FileCloud) Delete(ctx context.Context, filepath string) error {
+	if err := os.Remove(c.file(filepath)); err != nil {
+		return errors.WithStack(err)
+	}
+
+	return nil
+}
+
+// Path returns a path of the file with link u relative to the directory
+func (c *FileCloud) Path(u string) (string, error) {
+	if !strings.HasPrefix(u, c.publicURL) {
+		return "", errors.Errorf("%s isn't a link to %s", u, c.publicURL)
+	}
+
+	p, err := url.PathUnescape(strings.TrimPrefix(u, c.publicURL))
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	if strings.Contains(p, "..") {
+		return "", errors.New(fmt.Sprintf("path %s is outside of the directory", p))
+	}
+
+	return p, nil
+}
+
+// file returns a local path of a file with relative path p
+func (c *FileCloud) file(p string) string {
+	return filepath.Join(c.dir, filepath.FromSlash(p))
+}
@@ -0,0 +1,193 @@
+package service
+
+import (
+	"github.com/gocraft/dbr"
+	"github.com/gocraft/dbr/dialect"
+	"github.com/pkg/errors"
+	"time"
+	"videoconverter/domain"
+)
+
+// GenericStorage keeps videos in simple videos and renditions tables of PostgreSQL or SQLite database
+type GenericStorage struct {
+	db    *dbr.Connection
+	codes []string
+}
+
+// NewGenericStorage returns a ready for use instance of GenericStorage,
+// codes are property codes of all renditions
+func NewGenericStorage(dbConn *dbr.Connection, codes []string) *GenericStorage {
+	return &GenericStorage{
+		db:    dbConn,
+		codes: codes,
+	}
+}
+
+// Migrate creates videos and renditions tables if they aren't exist
+func (s *GenericStorage) Migrate() error {
+	id := "BIGSERIAL PRIMARY KEY"
+	if s.db.Dialect == dialect.SQLite3 {
+		id = "INTEGER PRIMARY KEY AUTOINCREMENT"
+	}
+
+	queries := []string{`
+CREATE TABLE IF NOT EXISTS videos (
+  id BIGINT PRIMARY KEY,
+  original_url TEXT NOT NULL DEFAULT '',
+  updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+)`, `
+CREATE TABLE IF NOT EXISTS renditions (
+  id ` + id + `,
+  video_id BIGINT NOT NULL REFERENCES videos (id) ON DELETE CASCADE,
+  code VARCHAR(64) NOT NULL,
+  url TEXT NOT NULL DEFAULT '',
+  updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  UNIQUE (video_id, code)
+)`}
+
+	for _, q := range queries {
+		if _, err := s.db.Exec(q); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	return nil
+}
+
+// Videos get all videos
+func (s *GenericStorage) Videos() ([]domain.Video, error) {
+	return s.videos(domain.VideoFilter{})
+}
+
+// FilterVideos get videos selected by f, the modification time is updated_at of the video,
+// all times are stored and compared in UTC because sqlite compares them as strings
+func (s *GenericStorage) FilterVideos(f domain.VideoFilter) ([]domain.Video, error) {
+	return s.videos(f)
+}
+
+// Video get a video by id
+func (s *GenericStorage) Video(id int64) (*domain.Video, error) {
+	v, err := s.videos(domain.VideoFilter{IDs: []int64{id}})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(v) == 0 {
+		return nil, errors.WithStack(domain.ErrNotFound)
+	}
+
+	return &v[0], nil
+}
+
+// videos get videos selected by f
+func (s *GenericStorage) videos(f domain.VideoFilter) ([]domain.Video, error) {
+	var v []domain.Video
+
+	session := s.db.NewSession(nil)
+
+	videos := session.
+		Select("id", "id AS id_original", "original_url AS link_original").
+		From("videos").
+		OrderBy("id")
+
+	props := session.
+		Select("video_id AS element_id", "code", "id", "url AS value").
+		From("renditions").
+		Where(dbr.Eq("code", s.codes))
+
+	if len(f.IDs) > 0 {
+		videos.Where(dbr.Eq("id", f.IDs))
+		props.Where(dbr.Eq("video_id", f.IDs))
+	}
+
+	if f.FromID > 0 {
+		videos.Where(dbr.Gte("id", f.FromID))
+		props.Where(dbr.Gte("video_id", f.FromID))
+	}
+
+	if f.ToID > 0 {
+		videos.Where(dbr.Lte("id", f.ToID))
+		props.Where(dbr.Lte("video_id", f.ToID))
+	}
+
+	if !f.Since.IsZero() {
+		videos.Where(dbr.Gte("updated_at", f.Since.UTC()))
+		props.Where("video_id IN (SELECT id FROM videos WHERE updated_at >= ?)", f.Since.UTC())
+	}
+
+	_, err := videos.Load(&v)
+
+	if err != nil {
+		return []domain.Video{}, errors.WithStack(err)
+	}
+
+	var pp []videoProperty
+
+	_, err = props.Load(&pp)
+	if err != nil {
+		return []domain.Video{}, errors.WithStack(err)
+	}
+
+	fillProps(v, pp, s.codes)
+
+	return v, nil
+}
+
+// SetLink saves a link to the rendition with code of video v
+func (s *GenericStorage) SetLink(v *domain.Video, code, link string) error {
+	_, err := s.db.NewSession(nil).
+		InsertBySql(`
+INSERT INTO renditions (video_id, code, url, updated_at)
+VALUES (?, ?, ?, ?)
+ON CONFLICT (video_id, code) DO UPDATE SET url = excluded.url, updated_at = excluded.updated_at
+`, v.ID, code, link, time.Now().UTC()).
+		Exec()
+
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	v.SetLink(code, link)
+
+	return nil
+}
+
+// ReplaceLink saves link to the rendition with code of video v if it still has link old
+func (s *GenericStorage) ReplaceLink(v *domain.Video, code, old, link string) error {
+	res, err := s.db.NewSession(nil).
+		Update("renditions").
+		Set("url", link).
+		Set("updated_at", time.Now().UTC()).
+		Where(dbr.And(dbr.Eq("video_id", v.ID), dbr.Eq("code", code), dbr.Eq("url", old))).
+		Exec()
+
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return errors.WithStack(err)
+	} else if n == 0 {
+		return errors.WithStack(domain.ErrLinkChanged)
+	}
+
+	v.SetLink(code, link)
+
+	return nil
+}
+
+// ClearOriginal clears the link to the original of video v
+func (s *GenericStorage) ClearOriginal(v *domain.Video) error {
+	_, err := s.db.NewSession(nil).
+		Update("videos").
+		Set("original_url", "").
+		Set("updated_at", time.Now().UTC()).
+		Where(dbr.Eq("id", v.ID)).
+		Exec()
+
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	return nil
+}
@@ -0,0 +1,136 @@
+package service
+
+import (
+	"github.com/gocraft/dbr"
+	"github.com/gocraft/dbr/dialect"
+	"github.com/pkg/errors"
+	"time"
+	"videoconverter/domain"
+)
+
+const jobsTable = "videoconverter_jobs"
+
+// JobStorage keeps processing states of videos in a dedicated table of MySQL, PostgreSQL or SQLite database
+type JobStorage struct {
+	db *dbr.Connection
+}
+
+// NewJobStorage returns a ready for use instance of JobStorage
+func NewJobStorage(dbConn *dbr.Connection) *JobStorage {
+	return &JobStorage{
+		db: dbConn,
+	}
+}
+
+// Migrate creates the jobs table if it isn't exists
+func (s *JobStorage) Migrate() error {
+	if s.db.Dialect == dialect.MySQL {
+		_, err := s.db.Exec(`
+CREATE TABLE IF NOT EXISTS ` + jobsTable + ` (
+  video_id BIGINT NOT NULL,
+  rendition VARCHAR(64) NOT NULL DEFAULT '',
+  state VARCHAR(16) NOT NULL,
+  error TEXT NOT NULL,
+  updated_at DATETIME NOT NULL,
+  PRIMARY KEY (video_id, rendition),
+  KEY state (state)
+)`)
+
+		return errors.WithStack(err)
+	}
+
+	queries := []string{`
+CREATE TABLE IF NOT EXISTS ` + jobsTable + ` (
+  video_id BIGINT NOT NULL,
+  rendition VARCHAR(64) NOT NULL DEFAULT '',
+  state VARCHAR(16) NOT NULL,
+  error TEXT NOT NULL,
+  updated_at TIMESTAMP NOT NULL,
+  PRIMARY KEY (video_id, rendition)
+)`,
+		`CREATE INDEX IF NOT EXISTS ` + jobsTable + `_state ON ` + jobsTable + ` (state)`,
+	}
+
+	for _, q := range queries {
+		if _, err := s.db.Exec(q); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	return nil
+}
+
+// SetState saves a state of the rendition of the video, msg is an error description for failed state
+func (s *JobStorage) SetState(videoID int64, rendition string, state domain.JobState, msg string) error {
+	upsert := `ON CONFLICT (video_id, rendition) DO UPDATE SET state = excluded.state, error = excluded.error, updated_at = excluded.updated_at`
+	if s.db.Dialect == dialect.MySQL {
+		upsert = `ON DUPLICATE KEY UPDATE state = VALUES(state), error = VALUES(error), updated_at = VALUES(updated_at)`
+	}
+
+	_, err := s.db.NewSession(nil).
+		InsertBySql(`
+INSERT INTO `+jobsTable+` (video_id, rendition, state, error, updated_at)
+VALUES (?, ?, ?, ?, ?)
+`+upsert, videoID, rendition, string(state), msg, time.Now()).
+		Exec()
+
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	return nil
+}
+
+// Jobs returns states of the video and all its renditions
+func (s *JobStorage) Jobs(videoID int64) ([]domain.Job, error) {
+	var jobs []domain.Job
+
+	_, err := s.db.NewSession(nil).
+		Select("video_id", "rendition", "state", "error", "updated_at").
+		From(jobsTable).
+		Where(dbr.Eq("video_id", videoID)).
+		OrderBy("rendition").
+		Load(&jobs)
+
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return jobs, nil
+}
+
+// All returns states of all videos and renditions
+func (s *JobStorage) All() ([]domain.Job, error) {
+	var jobs []domain.Job
+
+	_, err := s.db.NewSession(nil).
+		Select("video_id", "rendition", "state", "error", "updated_at").
+		From(jobsTable).
+		OrderBy("video_id").
+		OrderBy("rendition").
+		Load(&jobs)
+
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return jobs, nil
+}
+
+// Unfinished returns jobs which weren't done, failed or canceled, e.g. because of a crash
+func (s *JobStorage) Unfinished() ([]domain.Job, error) {
+	var jobs []domain.Job
+
+	_, err := s.db.NewSession(nil).
+		Select("video_id", "rendition", "state", "error", "updated_at").
+		From(jobsTable).
+		Where(dbr.Neq("state", []string{string(domain.JobDone), string(domain.JobFailed), string(domain.JobCanceled)})).
+		OrderBy("video_id").
+		Load(&jobs)
+
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return jobs, nil
+}
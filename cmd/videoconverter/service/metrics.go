@@ -0,0 +1,236 @@
+package service
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+	"net/http"
+	"time"
+)
+
+const metricsNamespace = "videoconverter"
+
+// Results of operations in metric labels
+const (
+	resultOK     = "ok"
+	resultFailed = "failed"
+)
+
+// Metrics collects processing metrics in a Prometheus registry
+type Metrics struct {
+	registry *prometheus.Registry
+
+	videos         prometheus.Counter
+	queued         prometheus.Gauge
+	processing     prometheus.Gauge
+	downloads      *prometheus.CounterVec
+	encodes        *prometheus.CounterVec
+	encodeDuration *prometheus.HistogramVec
+	uploads        *prometheus.CounterVec
+	uploadDuration prometheus.Histogram
+	bytes          *prometheus.CounterVec
+	retries        *prometheus.CounterVec
+}
+
+// NewMetrics returns a ready for use *Metrics with registered collectors,
+// go runtime and process metrics are included
+func NewMetrics() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		videos: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "videos_total",
+			Help:      "Number of videos got from the storage.",
+		}),
+		queued: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "queue_depth",
+			Help:      "Number of videos waiting for a worker.",
+		}),
+		processing: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "videos_processing",
+			Help:      "Number of videos processed right now.",
+		}),
+		downloads: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "downloads_total",
+			Help:      "Number of downloads of originals by result.",
+		}, []string{"result"}),
+		encodes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "encodes_total",
+			Help:      "Number of ffmpeg runs by rendition and result.",
+		}, []string{"rendition", "result"}),
+		encodeDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "encode_duration_seconds",
+			Help:      "Duration of ffmpeg runs by rendition.",
+			Buckets:   prometheus.ExponentialBuckets(10, 2, 10),
+		}, []string{"rendition"}),
+		uploads: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "uploads_total",
+			Help:      "Number of uploads to the cloud by result.",
+		}, []string{"result"}),
+		uploadDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "upload_duration_seconds",
+			Help:      "Duration of uploads to the cloud.",
+			Buckets:   prometheus.ExponentialBuckets(0.5, 2, 12),
+		}),
+		bytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "transferred_bytes_total",
+			Help:      "Number of bytes downloaded from and uploaded to the cloud.",
+		}, []string{"direction"}),
+		retries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "cloud_retries_total",
+			Help:      "Number of repeated cloud operations by operation.",
+		}, []string{"operation"}),
+	}
+
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.videos,
+		m.queued,
+		m.processing,
+		m.downloads,
+		m.encodes,
+		m.encodeDuration,
+		m.uploads,
+		m.uploadDuration,
+		m.bytes,
+		m.retries,
+	)
+
+	return m
+}
+
+// Handler returns an http handler of the /metrics endpoint
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// VideosFound counts videos got from the storage
+func (m *Metrics) VideosFound(n int) {
+	m.videos.Add(float64(n))
+}
+
+// Queued changes a number of videos waiting for a worker by delta
+func (m *Metrics) Queued(delta int) {
+	m.queued.Add(float64(delta))
+}
+
+// Processing changes a number of videos processed right now by delta
+func (m *Metrics) Processing(delta int) {
+	m.processing.Add(float64(delta))
+}
+
+// Downloaded counts a download of an original, bytes is a size of transferred data
+func (m *Metrics) Downloaded(bytes int64, err error) {
+	m.downloads.WithLabelValues(result(err)).Inc()
+	m.bytes.WithLabelValues("download").Add(float64(bytes))
+}
+
+// Encoded counts an ffmpeg run of rendition which took d
+func (m *Metrics) Encoded(rendition string, d time.Duration, err error) {
+	m.encodes.WithLabelValues(rendition, result(err)).Inc()
+
+	if err == nil {
+		m.encodeDuration.WithLabelValues(rendition).Observe(d.Seconds())
+	}
+}
+
+// Uploaded counts an upload of a file which took d
+func (m *Metrics) Uploaded(bytes int64, d time.Duration, err error) {
+	m.uploads.WithLabelValues(result(err)).Inc()
+
+	if err == nil {
+		m.uploadDuration.Observe(d.Seconds())
+		m.bytes.WithLabelValues("upload").Add(float64(bytes))
+	}
+}
+
+// Retried counts a repeated cloud operation op
+func (m *Metrics) Retried(op string) {
+	m.retries.WithLabelValues(op).Inc()
+}
+
+// MetricsSummary describe totals of a run
+type MetricsSummary struct {
+	Videos          int
+	Encoded         int
+	NotEncoded      int
+	Uploaded        int
+	NotUploaded     int
+	NotDownloaded   int
+	Retried         int
+	BytesDownloaded int64
+	BytesUploaded   int64
+}
+
+// Summary returns totals of all collected counters
+func (m *Metrics) Summary() MetricsSummary {
+	return MetricsSummary{
+		Videos:          int(sum(m.videos, nil)),
+		Encoded:         int(sum(m.encodes, map[string]string{"result": resultOK})),
+		NotEncoded:      int(sum(m.encodes, map[string]string{"result": resultFailed})),
+		Uploaded:        int(sum(m.uploads, map[string]string{"result": resultOK})),
+		NotUploaded:     int(sum(m.uploads, map[string]string{"result": resultFailed})),
+		NotDownloaded:   int(sum(m.downloads, map[string]string{"result": resultFailed})),
+		Retried:         int(sum(m.retries, nil)),
+		BytesDownloaded: int64(sum(m.bytes, map[string]string{"direction": "download"})),
+		BytesUploaded:   int64(sum(m.bytes, map[string]string{"direction": "upload"})),
+	}
+}
+
+// sum returns a sum of counters of collector c which have all labels
+func sum(c prometheus.Collector, labels map[string]string) float64 {
+	ch := make(chan prometheus.Metric)
+
+	go func() {
+		c.Collect(ch)
+		close(ch)
+	}()
+
+	var total float64
+
+	for metric := range ch {
+		var m dto.Metric
+		if err := metric.Write(&m); err != nil || m.Counter == nil {
+			continue
+		}
+
+		if hasLabels(&m, labels) {
+			total += m.Counter.GetValue()
+		}
+	}
+
+	return total
+}
+
+// hasLabels checks that metric m has all labels with their values
+func hasLabels(m *dto.Metric, labels map[string]string) bool {
+	found := 0
+
+	for _, l := range m.Label {
+		if v, ok := labels[l.GetName()]; ok && v == l.GetValue() {
+			found++
+		}
+	}
+
+	return found == len(labels)
+}
+
+// result returns a label value of an operation result
+func result(err error) string {
+	if err != nil {
+		return resultFailed
+	}
+
+	return resultOK
+}
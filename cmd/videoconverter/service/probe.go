@@ -0,0 +1,136 @@
+package service
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"math"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"videoconverter/domain"
+)
+
+var (
+	reDuration   = regexp.MustCompile(`Duration: (\d+):(\d+):(\d+(?:\.\d+)?)`)
+	reBitrate    = regexp.MustCompile(`(\d+) kb/s`)
+	reStream     = regexp.MustCompile(`^Stream #\d+:\d+.*?: (Video|Audio|Data|Subtitle|Attachment): (\w+)`)
+	reResolution = regexp.MustCompile(`, (\d{2,5})x(\d{2,5})`)
+	reFPS        = regexp.MustCompile(`, ([\d.]+) fps`)
+	reSampleRate = regexp.MustCompile(`, (\d+) Hz, ([^,]+)`)
+	reRotate     = regexp.MustCompile(`^rotate\s*:\s*(-?\d+)`)
+	reMatrix     = regexp.MustCompile(`displaymatrix: rotation of (-?[\d.]+) degrees`)
+)
+
+// Probe reads metadata of a media file from ffmpeg output
+func (e *VideoEncoder) Probe(ctx context.Context, filePath string) (*domain.MediaInfo, error) {
+	domain.LoggerFrom(ctx, e.l).Debug("probing", domain.Stage(domain.StageProbe), domain.F("file", filePath))
+
+	cmd := exec.CommandContext(ctx, e.ffmpeg, "-hide_banner", "-i", filePath)
+
+	// ffmpeg without an output file always exits with an error,
+	// so the result is checked by parsed metadata
+	out, _ := cmd.CombinedOutput()
+
+	info, err := parseProbe(out)
+	if err != nil {
+		return nil, errors.WithStack(cmdError{out, err})
+	}
+
+	return info, nil
+}
+
+// parseDuration returns a duration matched by reDuration
+func parseDuration(m []string) time.Duration {
+	h, _ := strconv.Atoi(m[1])
+	min, _ := strconv.Atoi(m[2])
+	sec, _ := strconv.ParseFloat(m[3], 64)
+
+	return time.Duration(h)*time.Hour +
+		time.Duration(min)*time.Minute +
+		time.Duration(sec*float64(time.Second))
+}
+
+// parseProbe parses a description of the first input printed by ffmpeg
+func parseProbe(out []byte) (*domain.MediaInfo, error) {
+	var info domain.MediaInfo
+
+	var current string
+	var hasVideo, isFirstVideo bool
+
+	for _, line := range strings.Split(string(out), "\n") {
+		line = strings.TrimSpace(line)
+
+		switch {
+		case strings.HasPrefix(line, "Duration:"):
+			if m := reDuration.FindStringSubmatch(line); m != nil {
+				info.Duration = parseDuration(m)
+			}
+
+			if m := reBitrate.FindStringSubmatch(line); m != nil {
+				info.Bitrate, _ = strconv.Atoi(m[1])
+			}
+
+		case strings.HasPrefix(line, "Stream #"):
+			m := reStream.FindStringSubmatch(line)
+			if m == nil {
+				current = ""
+				continue
+			}
+
+			current = m[1]
+			isFirstVideo = false
+
+			switch current {
+			case "Video":
+				if hasVideo {
+					continue
+				}
+
+				hasVideo, isFirstVideo = true, true
+				info.VideoCodec = m[2]
+
+				if r := reResolution.FindStringSubmatch(line); r != nil {
+					info.Width, _ = strconv.Atoi(r[1])
+					info.Height, _ = strconv.Atoi(r[2])
+				}
+
+				if r := reFPS.FindStringSubmatch(line); r != nil {
+					info.FPS, _ = strconv.ParseFloat(r[1], 64)
+				}
+
+			case "Audio":
+				a := domain.AudioStream{Codec: m[2]}
+
+				if r := reSampleRate.FindStringSubmatch(line); r != nil {
+					a.SampleRate, _ = strconv.Atoi(r[1])
+					a.Channels = strings.TrimSpace(r[2])
+				}
+
+				if r := reBitrate.FindStringSubmatch(line); r != nil {
+					a.Bitrate, _ = strconv.Atoi(r[1])
+				}
+
+				info.Audio = append(info.Audio, a)
+			}
+
+		case isFirstVideo:
+			if m := reRotate.FindStringSubmatch(line); m != nil {
+				info.Rotation, _ = strconv.Atoi(m[1])
+			} else if m := reMatrix.FindStringSubmatch(line); m != nil && info.Rotation == 0 {
+				// display matrix rotation is counterclockwise
+				deg, _ := strconv.ParseFloat(m[1], 64)
+				info.Rotation = int(math.Round(-deg))
+			}
+		}
+	}
+
+	if !hasVideo || info.Height == 0 {
+		return nil, errors.New("video stream is not found")
+	}
+
+	info.Rotation = ((info.Rotation % 360) + 360) % 360
+
+	return &info, nil
+}
@@ -0,0 +1,86 @@
+package service
+
+import (
+	"reflect"
+	"testing"
+	"time"
+	"videoconverter/domain"
+)
+
+func TestParseProbe(t *testing.T) {
+	tests := []struct {
+		name    string
+		out     string
+		want    *domain.MediaInfo
+		wantErr bool
+	}{
+		{
+			name: "video and audio",
+			out: `Input #0, mov,mp4,m4a,3gp,3g2,mj2, from 'a.mp4':
+  Duration: 00:01:30.50, start: 0.000000, bitrate: 2500 kb/s
+    Stream #0:0(und): Video: h264 (High) (avc1 / 0x31637661), yuv420p, 1920x1080 [SAR 1:1 DAR 16:9], 2300 kb/s, 25 fps, 25 tbr
+    Stream #0:1(und): Audio: aac (LC) (mp4a / 0x6134706D), 48000 Hz, stereo, fltp, 192 kb/s
+`,
+			want: &domain.MediaInfo{
+				Duration:   90*time.Second + 500*time.Millisecond,
+				Bitrate:    2500,
+				VideoCodec: "h264",
+				Width:      1920,
+				Height:     1080,
+				FPS:        25,
+				Audio:      []domain.AudioStream{{Codec: "aac", SampleRate: 48000, Channels: "stereo", Bitrate: 192}},
+			},
+		},
+		{
+			name: "rotate tag",
+			out: `  Duration: 00:00:10.00, start: 0.000000, bitrate: 1000 kb/s
+    Stream #0:0(und): Video: h264 (Main), yuv420p, 1280x720, 900 kb/s, 29.97 fps
+    Metadata:
+      rotate          : 90
+`,
+			want: &domain.MediaInfo{Duration: 10 * time.Second, Bitrate: 1000, VideoCodec: "h264", Width: 1280, Height: 720, FPS: 29.97, Rotation: 90},
+		},
+		{
+			name: "display matrix is counterclockwise",
+			out: `  Duration: 00:00:10.00, start: 0.000000, bitrate: 1000 kb/s
+    Stream #0:0: Video: hevc (Main), yuv420p, 1920x1080, 25 fps
+    Side data:
+      displaymatrix: rotation of -90.00 degrees
+`,
+			want: &domain.MediaInfo{Duration: 10 * time.Second, Bitrate: 1000, VideoCodec: "hevc", Width: 1920, Height: 1080, FPS: 25, Rotation: 90},
+		},
+		{
+			name: "only the first video stream",
+			out: `  Duration: 00:00:10.00, start: 0.000000, bitrate: 1000 kb/s
+    Stream #0:0: Video: h264 (Main), yuv420p, 640x360, 25 fps
+    Stream #0:1: Video: mjpeg, yuvj420p, 320x240, 90k tbr
+`,
+			want: &domain.MediaInfo{Duration: 10 * time.Second, Bitrate: 1000, VideoCodec: "h264", Width: 640, Height: 360, FPS: 25},
+		},
+		{
+			name: "audio only",
+			out: `  Duration: 00:00:10.00, start: 0.000000, bitrate: 128 kb/s
+    Stream #0:0: Audio: mp3, 44100 Hz, stereo, fltp, 128 kb/s
+`,
+			wantErr: true,
+		},
+		{
+			name:    "not a media file",
+			out:     "a.txt: Invalid data found when processing input\n",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseProbe([]byte(tt.out))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseProbe() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseProbe() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
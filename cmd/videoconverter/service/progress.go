@@ -0,0 +1,143 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"github.com/pkg/errors"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"videoconverter/domain"
+)
+
+// run runs ffmpeg with args and reports its progress to the callback of ctx,
+// limit is a max duration of outputs (e.g. of a preview), 0 means the whole input
+func (e *VideoEncoder) run(ctx context.Context, limit time.Duration, args ...string) error {
+	args = append([]string{"-nostats", "-progress", "pipe:1"}, args...)
+	cmd := exec.CommandContext(ctx, e.ffmpeg, args...)
+	// ffmpeg doesn't get Ctrl+C of the terminal, it's stopped by ctx after the grace period of a shutdown
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if err := cmd.Start(); err != nil {
+		return errors.WithStack(err)
+	}
+
+	// ffmpeg prints a duration of the input into stderr before it starts encoding
+	var total int64
+	var out bytes.Buffer
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		s := bufio.NewScanner(stderr)
+		for s.Scan() {
+			out.Write(s.Bytes())
+			out.WriteByte('\n')
+
+			if m := reDuration.FindStringSubmatch(s.Text()); m != nil && atomic.LoadInt64(&total) == 0 {
+				atomic.StoreInt64(&total, int64(parseDuration(m)))
+			}
+		}
+
+		io.Copy(io.Discard, stderr)
+	}()
+
+	report := domain.ProgressFrom(ctx)
+	if report == nil {
+		report = func(domain.Progress) {}
+	}
+
+	readProgress(stdout, func(p domain.Progress) {
+		p.Total = time.Duration(atomic.LoadInt64(&total))
+		if limit > 0 && (p.Total == 0 || p.Total > limit) {
+			p.Total = limit
+		}
+
+		report(estimate(p))
+	})
+
+	<-done
+
+	if err := cmd.Wait(); err != nil {
+		return errors.WithStack(cmdError{out.Bytes(), err})
+	}
+
+	return nil
+}
+
+// readProgress parses blocks of key=value lines printed by ffmpeg -progress,
+// fn is called at the end of every block
+func readProgress(r io.Reader, fn func(p domain.Progress)) {
+	var p domain.Progress
+
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		kv := strings.SplitN(strings.TrimSpace(s.Text()), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+
+		key, value := kv[0], strings.TrimSpace(kv[1])
+
+		switch key {
+		case "frame":
+			p.Frame, _ = strconv.ParseInt(value, 10, 64)
+		case "fps":
+			p.FPS, _ = strconv.ParseFloat(value, 64)
+		case "out_time_us", "out_time_ms":
+			// out_time_ms is in microseconds too, it's printed by old ffmpeg versions
+			if us, err := strconv.ParseInt(value, 10, 64); err == nil && us >= 0 {
+				p.OutTime = time.Duration(us) * time.Microsecond
+			}
+		case "speed":
+			p.Speed, _ = strconv.ParseFloat(strings.TrimSuffix(value, "x"), 64)
+		case "progress":
+			if value == "end" {
+				p.Percent = 100
+			}
+
+			fn(p)
+		}
+	}
+
+	io.Copy(io.Discard, r)
+}
+
+// estimate fills percent complete and remaining time of p by its total duration
+func estimate(p domain.Progress) domain.Progress {
+	if p.Percent == 100 {
+		p.ETA = 0
+		return p
+	}
+
+	if p.Total <= 0 {
+		return p
+	}
+
+	p.Percent = float64(p.OutTime) / float64(p.Total) * 100
+	if p.Percent > 100 {
+		p.Percent = 100
+	}
+
+	if p.Speed > 0 && p.OutTime < p.Total {
+		p.ETA = time.Duration(float64(p.Total-p.OutTime) / p.Speed)
+	}
+
+	return p
+}
@@ -0,0 +1,65 @@
+package service
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+	"videoconverter/domain"
+)
+
+func TestReadProgress(t *testing.T) {
+	tests := []struct {
+		name string
+		out  string
+		want []domain.Progress
+	}{
+		{
+			name: "blocks",
+			out: `frame=50
+fps=25.00
+out_time_us=2000000
+speed=2.0x
+progress=continue
+frame=100
+fps=25.00
+out_time_us=4000000
+speed=2.1x
+progress=end
+`,
+			want: []domain.Progress{
+				{Frame: 50, FPS: 25, OutTime: 2 * time.Second, Speed: 2},
+				{Frame: 100, FPS: 25, OutTime: 4 * time.Second, Speed: 2.1, Percent: 100},
+			},
+		},
+		{
+			name: "old out_time_ms and unknown values",
+			out: `frame=10
+out_time_ms=500000
+out_time_us=N/A
+speed=N/A
+bitrate=N/A
+progress=continue
+`,
+			want: []domain.Progress{{Frame: 10, OutTime: 500 * time.Millisecond}},
+		},
+		{
+			name: "block without end",
+			out:  "frame=10\nfps=25\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []domain.Progress
+
+			readProgress(strings.NewReader(tt.out), func(p domain.Progress) {
+				got = append(got, p)
+			})
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("readProgress() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,128 @@
+package service
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"math/rand"
+	"os"
+	"time"
+	"videoconverter/domain"
+)
+
+// RetryCloud wraps a Clouder and repeats failed operations with exponential backoff
+type RetryCloud struct {
+	cloud   domain.Clouder
+	policy  domain.RetryPolicy
+	metrics domain.Metrics
+
+	l domain.Logger
+}
+
+// NewRetryCloud returns a ready for use *RetryCloud instance
+func NewRetryCloud(cloud domain.Clouder, policy domain.RetryPolicy, metrics domain.Metrics, l domain.Logger) *RetryCloud {
+	return &RetryCloud{
+		cloud:   cloud,
+		policy:  policy,
+		metrics: metrics,
+		l:       l,
+	}
+}
+
+// DownloadFile downloads a file from url u into file f, every attempt continues the previous one
+func (c *RetryCloud) DownloadFile(ctx context.Context, u string, f *os.File) error {
+	return c.do(ctx, "download", u, func() error {
+		return c.cloud.DownloadFile(ctx, u, f)
+	})
+}
+
+// UploadFile uploads a file to the cloud, every attempt reads the file from the beginning
+func (c *RetryCloud) UploadFile(ctx context.Context, path string, f *os.File) (string, error) {
+	var u string
+
+	err := c.do(ctx, "upload", path, func() error {
+		if _, err := f.Seek(0, 0); err != nil {
+			return errors.WithStack(err)
+		}
+
+		var err error
+		u, err = c.cloud.UploadFile(ctx, path, f)
+
+		return err
+	})
+
+	return u, err
+}
+
+// Delete deletes a file from the cloud
+func (c *RetryCloud) Delete(ctx context.Context, filepath string) error {
+	return c.do(ctx, "delete", filepath, func() error {
+		return c.cloud.Delete(ctx, filepath)
+	})
+}
+
+// Path returns a path of the file with link u in the cloud
+func (c *RetryCloud) Path(u string) (string, error) {
+	return c.cloud.Path(u)
+}
+
+// do calls fn until it succeeds, returns a not retryable error or attempts are over,
+// op is a name of the operation with a file name
+func (c *RetryCloud) do(ctx context.Context, op, name string, fn func() error) error {
+	var err error
+
+	for attempt := 1; ; attempt++ {
+		err = fn()
+		if err == nil || attempt >= c.policy.MaxAttempts || !c.isRetryable(err) {
+			return err
+		}
+
+		delay := c.delay(attempt)
+
+		domain.LoggerFrom(ctx, c.l).Warn("cloud operation failed, retrying",
+			domain.F("operation", op),
+			domain.F("file", name),
+			domain.F("attempt", attempt),
+			domain.F("max_attempts", c.policy.MaxAttempts),
+			domain.F("delay_ms", delay.Milliseconds()),
+			domain.Err(err),
+		)
+		c.metrics.Retried(op)
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+	}
+}
+
+// isRetryable checks that an operation failed with err can succeed next time
+func (c *RetryCloud) isRetryable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, ErrFreeSpace) {
+		return false
+	}
+
+	var se StatusError
+	if errors.As(err, &se) {
+		return c.policy.IsRetryableStatus(se.Code)
+	}
+
+	// network errors, broken connections and incomplete files
+	return true
+}
+
+// delay returns a pause before the next attempt: the base delay doubled for every attempt,
+// limited by the max delay and randomized by jitter
+func (c *RetryCloud) delay(attempt int) time.Duration {
+	d := c.policy.BaseDelay << (attempt - 1)
+	if d > c.policy.MaxDelay || d <= 0 {
+		d = c.policy.MaxDelay
+	}
+
+	if c.policy.Jitter > 0 {
+		j := float64(d) * c.policy.Jitter
+		d += time.Duration(j * (2*rand.Float64() - 1))
+	}
+
+	return d
+}
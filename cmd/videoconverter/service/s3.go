@@ -0,0 +1,271 @@
+package service
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+	"videoconverter/bootstrap"
+	"videoconverter/domain"
+)
+
+// unsignedPayload is used instead of a body hash, so a file isn't read twice before an upload
+const unsignedPayload = "UNSIGNED-PAYLOAD"
+
+// S3 describe an S3-compatible object storage (AWS S3, MinIO...), objects are addressed in path style
+type S3 struct {
+	client    *http.Client
+	endpoint  *url.URL
+	region    string
+	bucket    string
+	accessKey string
+	secretKey string
+	publicURL string
+
+	l domain.Logger
+}
+
+// NewS3 returns ready for use *S3 instance, publicURL is a base url of links to uploaded objects,
+// by default it's the bucket url on the endpoint
+func NewS3(client *http.Client, c bootstrap.S3, l domain.Logger) (*S3, error) {
+	endpoint, err := url.Parse(strings.TrimSuffix(c.Endpoint, "/"))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	publicURL := c.PublicURL
+	if publicURL == "" {
+		publicURL = fmt.Sprintf("%s/%s/", endpoint, c.Bucket)
+	}
+
+	if !strings.HasSuffix(publicURL, "/") {
+		publicURL += "/"
+	}
+
+	return &S3{
+		client:    client,
+		endpoint:  endpoint,
+		region:    c.Region,
+		bucket:    c.Bucket,
+		accessKey: c.AccessKey,
+		secretKey: c.SecretKey,
+		publicURL: publicURL,
+		l:         l,
+	}, nil
+}
+
+// DownloadFile downloads a file from url u into file f,
+// objects of the bucket are requested with authorization, other urls are downloaded as is
+func (s *S3) DownloadFile(ctx context.Context, u string, f *os.File) error {
+	key, ok := s.key(u)
+	if !ok {
+		return download(ctx, s.client, u, f, nil, s.l)
+	}
+
+	return download(ctx, s.client, s.objectURL(key).String(), f, func(req *http.Request) error {
+		s.sign(req, unsignedPayload)
+		return nil
+	}, s.l)
+}
+
+// UploadFile uploads a file to the bucket with key
+func (s *S3) UploadFile(ctx context.Context, key string, f *os.File) (string, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	offset, err := f.Seek(0, 1)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	// the transport closes a request body, so it gets a reader of the file which the caller still owns
+	size := info.Size() - offset
+	body := func() io.ReadCloser {
+		return ioutil.NopCloser(io.NewSectionReader(f, offset, size))
+	}
+
+	req, err := http.NewRequest(http.MethodPut, s.objectURL(key).String(), body())
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	req = req.WithContext(ctx)
+	req.ContentLength = size
+	req.GetBody = func() (io.ReadCloser, error) {
+		return body(), nil
+	}
+
+	if t := mime.TypeByExtension(path.Ext(key)); t != "" {
+		req.Header.Set("Content-Type", t)
+	}
+
+	s.sign(req, unsignedPayload)
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	defer func() {
+		if err := res.Body.Close(); err != nil {
+			s.l.Warn("can't close response body", domain.Err(err))
+		}
+	}()
+
+	if res.StatusCode != http.StatusOK {
+		return "", errors.WithStack(StatusError{res.StatusCode})
+	}
+
+	return s.publicURL + key, nil
+}
+
+// Delete deletes an object with key filepath from the bucket
+func (s *S3) Delete(ctx context.Context, filepath string) error {
+	req, err := http.NewRequest(http.MethodDelete, s.objectURL(filepath).String(), nil)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	req = req.WithContext(ctx)
+
+	s.sign(req, emptyHash)
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	defer func() {
+		if err := res.Body.Close(); err != nil {
+			s.l.Warn("can't close response body", domain.Err(err))
+		}
+	}()
+
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusNoContent {
+		return errors.WithStack(StatusError{res.StatusCode})
+	}
+
+	return nil
+}
+
+// Path returns a key of the object with link u
+func (s *S3) Path(u string) (string, error) {
+	key, ok := s.key(u)
+	if !ok {
+		return "", errors.Errorf("%s isn't a link to bucket %s", u, s.bucket)
+	}
+
+	return key, nil
+}
+
+// key returns a key of the object with link u, u can be a public link or a link to the endpoint
+func (s *S3) key(u string) (string, bool) {
+	if strings.HasPrefix(u, s.publicURL) {
+		key, err := url.PathUnescape(strings.TrimPrefix(u, s.publicURL))
+		return key, err == nil
+	}
+
+	cURL, err := url.Parse(u)
+	if err != nil || cURL.Host != s.endpoint.Host {
+		return "", false
+	}
+
+	prefix := strings.TrimSuffix(s.endpoint.Path, "/") + "/" + s.bucket + "/"
+	if !strings.HasPrefix(cURL.Path, prefix) {
+		return "", false
+	}
+
+	return strings.TrimPrefix(cURL.Path, prefix), true
+}
+
+// objectURL returns a path style url of the object with key
+func (s *S3) objectURL(key string) *url.URL {
+	p := strings.TrimSuffix(s.endpoint.Path, "/") + "/" + s.bucket + "/" + key
+
+	return &url.URL{
+		Scheme:  s.endpoint.Scheme,
+		Host:    s.endpoint.Host,
+		Path:    p,
+		RawPath: s3Escape(p),
+	}
+}
+
+// emptyHash is a sha256 hash of an empty body
+const emptyHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// sign adds AWS Signature Version 4 headers to req, payloadHash is a hex sha256 of the body
+// or UNSIGNED-PAYLOAD
+func (s *S3) sign(req *http.Request, payloadHash string) {
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	const signedHeaders = "host;x-amz-content-sha256;x-amz-date"
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.Query().Encode(),
+		"host:" + req.URL.Host + "\n" +
+			"x-amz-content-sha256:" + payloadHash + "\n" +
+			"x-amz-date:" + amzDate + "\n",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, hex.EncodeToString(hmacSHA256(key, stringToSign)),
+	))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+
+	return h.Sum(nil)
+}
+
+// s3Escape encodes a path as S3 expects: every byte except unreserved characters and slashes
+func s3Escape(p string) string {
+	b := &strings.Builder{}
+
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || c == '/' {
+			b.WriteByte(c)
+			continue
+		}
+
+		fmt.Fprintf(b, "%%%02X", c)
+	}
+
+	return b.String()
+}